@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/spf13/viper"
 
@@ -11,14 +12,80 @@ import (
 )
 
 const (
-	ConfigKeyLogPath     = "gateway.LogPath"
-	ConfigKeyLogSaveName = "gateway.LogSaveName"
-	ConfigKeyLogFileExt  = "gateway.LogFileExt"
-	ConfigKeyGatewayPort = "gateway.Port"
-	ConfigKeyRuntimePath = "common.RuntimePath"
+	ConfigKeyLogPath         = "gateway.LogPath"
+	ConfigKeyLogSaveName     = "gateway.LogSaveName"
+	ConfigKeyLogFileExt      = "gateway.LogFileExt"
+	ConfigKeyLogLevel        = "gateway.LogLevel"
+	ConfigKeyGatewayPort     = "gateway.Port"
+	ConfigKeyListenAddresses = "gateway.ListenAddresses"
+	ConfigKeyDrainTimeout    = "gateway.DrainTimeout"
+	ConfigKeyReservedPaths   = "gateway.ReservedPaths"
+	ConfigKeyRuntimePath     = "common.RuntimePath"
+
+	ConfigKeyTLSEnabled        = "tls.Enabled"
+	ConfigKeyTLSCertFile       = "tls.CertFile"
+	ConfigKeyTLSKeyFile        = "tls.KeyFile"
+	ConfigKeyTLSCertificates   = "tls.Certificates"
+	ConfigKeyTLSSelfSigned     = "tls.SelfSigned"
+	ConfigKeyTLSSelfSignedPath = "tls.SelfSignedPath"
+	ConfigKeyTLSRedirectHTTP   = "tls.RedirectHTTP"
+	ConfigKeyTLSHTTPPort       = "tls.HTTPPort"
+
+	ConfigKeyACMEEnabled         = "acme.Enabled"
+	ConfigKeyACMEDomains         = "acme.Domains"
+	ConfigKeyACMEEmail           = "acme.Email"
+	ConfigKeyACMEDirectoryURL    = "acme.DirectoryURL"
+	ConfigKeyACMECARootFile      = "acme.CARootFile"
+	ConfigKeyACMEChallenges      = "acme.Challenges"
+	ConfigKeyACMEPath            = "acme.Path"
+	ConfigKeyACMERenewBeforeDays = "acme.RenewBeforeDays"
+
+	ConfigKeyHeadersHSTS                  = "headers.HSTS"
+	ConfigKeyHeadersContentTypeOptions    = "headers.ContentTypeOptions"
+	ConfigKeyHeadersReferrerPolicy        = "headers.ReferrerPolicy"
+	ConfigKeyHeadersFrameOptions          = "headers.FrameOptions"
+	ConfigKeyHeadersFrameAncestors        = "headers.FrameAncestors"
+	ConfigKeyHeadersContentSecurityPolicy = "headers.ContentSecurityPolicy"
+
+	ConfigKeyManagementLoopbackBypass = "management.LoopbackBypass"
+	ConfigKeyManagementUnixSocket     = "management.UnixSocket"
+	ConfigKeyManagementAllowUIDs      = "management.AllowUIDs"
+	ConfigKeyManagementAllowGIDs      = "management.AllowGIDs"
+	ConfigKeyManagementTLSAddress     = "management.TLSAddress"
+	ConfigKeyManagementCertFile       = "management.CertFile"
+	ConfigKeyManagementKeyFile        = "management.KeyFile"
+	ConfigKeyManagementClientCAFile   = "management.ClientCAFile"
+	ConfigKeyManagementAdmins         = "management.Admins"
+
+	ConfigKeyAccessLogEnabled    = "accesslog.Enabled"
+	ConfigKeyAccessLogFormat     = "accesslog.Format"
+	ConfigKeyAccessLogMaxSize    = "accesslog.MaxSize"
+	ConfigKeyAccessLogMaxBackups = "accesslog.MaxBackups"
+	ConfigKeyAccessLogMaxAge     = "accesslog.MaxAge"
+	ConfigKeyAccessLogSampleRate = "accesslog.SampleRate"
+
+	ConfigKeyRequestIDHeader = "requestid.Header"
+	ConfigKeyRequestIDFormat = "requestid.Format"
+
+	ConfigKeyTracingEnabled    = "tracing.Enabled"
+	ConfigKeyTracingEndpoint   = "tracing.Endpoint"
+	ConfigKeyTracingSampleRate = "tracing.SampleRate"
+
+	ConfigKeySlowRequestThreshold = "slowrequest.Threshold"
+
+	ConfigKeyCORSAllowOrigins     = "cors.AllowOrigins"
+	ConfigKeyCORSAllowMethods     = "cors.AllowMethods"
+	ConfigKeyCORSAllowHeaders     = "cors.AllowHeaders"
+	ConfigKeyCORSAllowCredentials = "cors.AllowCredentials"
+	ConfigKeyCORSMaxAge           = "cors.MaxAge"
 
 	GatewayName       = "gateway"
 	GatewayConfigType = "ini"
+
+	// published in runtime path, next to management.url
+	ManagementUnixURLFilename = "management-unix.url"
+	ManagementSocketFilename  = "management.sock"
+	ManagementTLSURLFilename  = "management-tls.url"
 )
 
 func LoadConfig() (*viper.Viper, error) {
@@ -27,6 +94,49 @@ func LoadConfig() (*viper.Viper, error) {
 	config.SetDefault(ConfigKeyLogPath, constants.DefaultLogPath)
 	config.SetDefault(ConfigKeyLogSaveName, GatewayName)
 	config.SetDefault(ConfigKeyLogFileExt, "log")
+	config.SetDefault(ConfigKeyLogLevel, "info")
+	config.SetDefault(ConfigKeyDrainTimeout, 30) // seconds
+	config.SetDefault(ConfigKeyReservedPaths, "/,/v1/gateway")
+
+	config.SetDefault(ConfigKeyTLSEnabled, false)
+	config.SetDefault(ConfigKeyTLSSelfSigned, false)
+	config.SetDefault(ConfigKeyTLSSelfSignedPath, filepath.Join(constants.DefaultConfigPath, GatewayName, "tls"))
+	config.SetDefault(ConfigKeyTLSRedirectHTTP, false)
+
+	config.SetDefault(ConfigKeyACMEEnabled, false)
+	config.SetDefault(ConfigKeyACMEDirectoryURL, "https://acme-v02.api.letsencrypt.org/directory")
+	config.SetDefault(ConfigKeyACMEChallenges, "tls-alpn-01,http-01")
+	config.SetDefault(ConfigKeyACMEPath, filepath.Join(constants.DefaultConfigPath, GatewayName, "acme"))
+	config.SetDefault(ConfigKeyACMERenewBeforeDays, 30)
+
+	config.SetDefault(ConfigKeyHeadersContentTypeOptions, "nosniff")
+	config.SetDefault(ConfigKeyHeadersReferrerPolicy, "strict-origin-when-cross-origin")
+	config.SetDefault(ConfigKeyHeadersFrameAncestors, "'self'") // so that apps can still be embedded in the CasaOS UI
+
+	config.SetDefault(ConfigKeyManagementLoopbackBypass, true)
+	config.SetDefault(ConfigKeyManagementUnixSocket, true)
+	config.SetDefault(ConfigKeyManagementAllowUIDs, "0")
+
+	config.SetDefault(ConfigKeyAccessLogEnabled, true)
+	config.SetDefault(ConfigKeyAccessLogFormat, "combined")
+	config.SetDefault(ConfigKeyAccessLogMaxSize, 10)
+	config.SetDefault(ConfigKeyAccessLogMaxBackups, 10)
+	config.SetDefault(ConfigKeyAccessLogMaxAge, 7)
+	config.SetDefault(ConfigKeyAccessLogSampleRate, 1)
+
+	config.SetDefault(ConfigKeyRequestIDHeader, "X-Request-ID")
+	config.SetDefault(ConfigKeyRequestIDFormat, "uuid")
+
+	config.SetDefault(ConfigKeyTracingEnabled, false)
+	config.SetDefault(ConfigKeyTracingEndpoint, "http://localhost:4318")
+	config.SetDefault(ConfigKeyTracingSampleRate, 1)
+
+	config.SetDefault(ConfigKeySlowRequestThreshold, 3) // seconds
+
+	config.SetDefault(ConfigKeyCORSAllowMethods, "GET,POST,PUT,DELETE,OPTIONS")
+	config.SetDefault(ConfigKeyCORSAllowHeaders, "Authorization,Content-Length,X-CSRF-Token,Content-Type,Access-Control-Allow-Origin,Access-Control-Allow-Headers,Access-Control-Allow-Methods,Connection,Origin,X-Requested-With")
+	config.SetDefault(ConfigKeyCORSAllowCredentials, true)
+	config.SetDefault(ConfigKeyCORSMaxAge, 172800)
 
 	config.SetDefault(ConfigKeyRuntimePath, constants.DefaultRuntimePath) // See https://refspecs.linuxfoundation.org/FHS_3.0/fhs/ch05s13.html
 
@@ -52,3 +162,18 @@ func LoadConfig() (*viper.Viper, error) {
 
 	return config, nil
 }
+
+// GetStringList returns the value at `key` as a list, split by comma.
+//
+// (viper only splits by whitespace, which does not read well in an ini file)
+func GetStringList(config *viper.Viper, key string) []string {
+	list := make([]string, 0)
+
+	for _, item := range strings.Split(config.GetString(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
@@ -2,46 +2,77 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/IceWhaleTech/CasaOS-Common/external"
-	"github.com/IceWhaleTech/CasaOS-Common/model"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/constants"
-	http2 "github.com/IceWhaleTech/CasaOS-Common/utils/http"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/coreos/go-systemd/activation"
 	"github.com/coreos/go-systemd/daemon"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
 
 	"github.com/IceWhaleTech/CasaOS-Gateway/common"
+	"github.com/IceWhaleTech/CasaOS-Gateway/pkg"
 	"github.com/IceWhaleTech/CasaOS-Gateway/route"
 	"github.com/IceWhaleTech/CasaOS-Gateway/service"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-const localhost = "127.0.0.1"
+const (
+	localhost   = "127.0.0.1"
+	pidFilename = "gateway.pid"
+)
 
 var (
 	commit = "private build"
 	date   = "private build"
 
 	_state   *service.State
-	_gateway *http.Server
+	_logging *service.Logging
+
+	// by the address each one listens on - they all serve the same routes
+	_gateways      = make(map[string]*service.Server)
+	_gatewaysMutex sync.Mutex
+
+	// the management and static servers, by their listener
+	_servers      = make(map[string]*service.Server)
+	_serversMutex sync.Mutex
+
+	// previous gateways still serving their last requests
+	_draining sync.WaitGroup
+
+	// the listeners of the process, possibly from the one it upgrades
+	_upgrade *service.Upgrade
+
+	// once a new process has taken over, which this one leaves the runtime files to
+	_upgraded atomic.Bool
+
+	// keeps systemd informed once the gateway is ready
+	_watchdog *service.Watchdog
 
 	_managementServiceReady = make(chan struct{})
 	_gatewayServiceReady    = make(chan struct{})
 
-	ErrCheckURLNotOK = errors.New("check url did not return 200 OK")
-
 	//go:embed build/sysroot/etc/casaos/gateway.ini.sample
 	_confSample string
 )
@@ -84,12 +115,28 @@ func init() {
 		panic(err)
 	}
 
-	logger.LogInit(
-		config.GetString(common.ConfigKeyLogPath),
-		config.GetString(common.ConfigKeyLogSaveName),
-		config.GetString(common.ConfigKeyLogFileExt),
+	logLevel, err := zapcore.ParseLevel(config.GetString(common.ConfigKeyLogLevel))
+	if err != nil {
+		panic(err)
+	}
+
+	// the same outputs as `logger.LogInit`, so that the level can be changed while running
+	_logging = service.NewLogging(logLevel,
+		zapcore.AddSync(os.Stdout),
+		zapcore.AddSync(&lumberjack.Logger{
+			Filename: filepath.Join(
+				config.GetString(common.ConfigKeyLogPath),
+				config.GetString(common.ConfigKeyLogSaveName)+"."+config.GetString(common.ConfigKeyLogFileExt),
+			),
+			MaxSize:    10,
+			MaxBackups: 60,
+			MaxAge:     1,
+			Compress:   true,
+		}),
 	)
 
+	logger.LogInitWithWriterSyncers(_logging.Outputs()...)
+
 	runtimePath := config.GetString(common.ConfigKeyRuntimePath)
 	if err := _state.SetRuntimePath(runtimePath); err != nil {
 		logger.Error("Failed to set runtime path", zap.Any("error", err), zap.Any(common.ConfigKeyRuntimePath, runtimePath))
@@ -102,6 +149,153 @@ func init() {
 		panic(err)
 	}
 
+	listenAddresses, err := service.ParseListenAddresses(common.GetStringList(config, common.ConfigKeyListenAddresses))
+	if err != nil {
+		logger.Error("Failed to read listen addresses", zap.Any("error", err), zap.Any(common.ConfigKeyListenAddresses, config.GetString(common.ConfigKeyListenAddresses)))
+		panic(err)
+	}
+
+	if err := _state.SetListenAddresses(listenAddresses); err != nil {
+		logger.Error("Failed to set listen addresses", zap.Any("error", err))
+		panic(err)
+	}
+
+	reservedPaths := common.GetStringList(config, common.ConfigKeyReservedPaths)
+	if err := _state.SetReservedPaths(reservedPaths); err != nil {
+		logger.Error("Failed to set reserved paths", zap.Any("error", err), zap.Any(common.ConfigKeyReservedPaths, reservedPaths))
+		panic(err)
+	}
+
+	tlsOptions, err := tlsOptionsFrom(config)
+	if err != nil {
+		logger.Error("Failed to read TLS options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetTLSOptions(tlsOptions); err != nil {
+		logger.Error("Failed to set TLS options", zap.Any("error", err))
+		panic(err)
+	}
+
+	acmeOptions, err := acmeOptionsFrom(config)
+	if err != nil {
+		logger.Error("Failed to read ACME options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetACMEOptions(acmeOptions); err != nil {
+		logger.Error("Failed to set ACME options", zap.Any("error", err))
+		panic(err)
+	}
+
+	securityHeaders := service.SecurityHeaders{
+		HSTS:                  config.GetString(common.ConfigKeyHeadersHSTS),
+		ContentTypeOptions:    config.GetString(common.ConfigKeyHeadersContentTypeOptions),
+		ReferrerPolicy:        config.GetString(common.ConfigKeyHeadersReferrerPolicy),
+		FrameOptions:          config.GetString(common.ConfigKeyHeadersFrameOptions),
+		FrameAncestors:        config.GetString(common.ConfigKeyHeadersFrameAncestors),
+		ContentSecurityPolicy: config.GetString(common.ConfigKeyHeadersContentSecurityPolicy),
+	}
+
+	if err := _state.SetSecurityHeaders(securityHeaders); err != nil {
+		logger.Error("Failed to set security headers", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetCORSOptions(corsOptionsFrom(config)); err != nil {
+		logger.Error("Failed to set CORS options", zap.Any("error", err))
+		panic(err)
+	}
+
+	managementOptions, err := managementOptionsFrom(config, runtimePath)
+	if err != nil {
+		logger.Error("Failed to read management options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetManagementOptions(managementOptions); err != nil {
+		logger.Error("Failed to set management options", zap.Any("error", err))
+		panic(err)
+	}
+
+	// next to the log, e.g. /var/log/casaos/gateway-audit.log
+	auditLogPath := filepath.Join(
+		config.GetString(common.ConfigKeyLogPath),
+		config.GetString(common.ConfigKeyLogSaveName)+"-audit."+config.GetString(common.ConfigKeyLogFileExt),
+	)
+	if err := _state.SetAuditLogPath(auditLogPath); err != nil {
+		logger.Error("Failed to set audit log path", zap.Any("error", err), zap.String("auditLogPath", auditLogPath))
+		panic(err)
+	}
+
+	accessLogOptions, err := accessLogOptionsFrom(config)
+	if err != nil {
+		logger.Error("Failed to read access log options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetAccessLogOptions(accessLogOptions); err != nil {
+		logger.Error("Failed to set access log options", zap.Any("error", err))
+		panic(err)
+	}
+
+	requestIDOptions := service.RequestIDOptions{
+		Header: config.GetString(common.ConfigKeyRequestIDHeader),
+		Format: config.GetString(common.ConfigKeyRequestIDFormat),
+	}
+
+	if requestIDOptions.Header == "" || (requestIDOptions.Format != service.RequestIDFormatUUID && requestIDOptions.Format != service.RequestIDFormatHex) {
+		err := fmt.Errorf("%s must not be empty, and %s must be %s or %s", common.ConfigKeyRequestIDHeader, common.ConfigKeyRequestIDFormat, service.RequestIDFormatUUID, service.RequestIDFormatHex)
+		logger.Error("Failed to read request ID options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetRequestIDOptions(requestIDOptions); err != nil {
+		logger.Error("Failed to set request ID options", zap.Any("error", err))
+		panic(err)
+	}
+
+	tracingOptions := service.TracingOptions{
+		Enabled:    config.GetBool(common.ConfigKeyTracingEnabled),
+		Endpoint:   config.GetString(common.ConfigKeyTracingEndpoint),
+		SampleRate: config.GetFloat64(common.ConfigKeyTracingSampleRate),
+	}
+
+	if tracingOptions.SampleRate < 0 || tracingOptions.SampleRate > 1 {
+		err := fmt.Errorf("%s must be between 0 and 1", common.ConfigKeyTracingSampleRate)
+		logger.Error("Failed to read tracing options", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetTracingOptions(tracingOptions); err != nil {
+		logger.Error("Failed to set tracing options", zap.Any("error", err))
+		panic(err)
+	}
+
+	slowRequestThreshold := config.GetFloat64(common.ConfigKeySlowRequestThreshold)
+	if slowRequestThreshold < 0 {
+		err := fmt.Errorf("%s must not be negative", common.ConfigKeySlowRequestThreshold)
+		logger.Error("Failed to read slow request threshold", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetSlowRequestThreshold(time.Duration(slowRequestThreshold * float64(time.Second))); err != nil {
+		logger.Error("Failed to set slow request threshold", zap.Any("error", err))
+		panic(err)
+	}
+
+	drainTimeout := config.GetFloat64(common.ConfigKeyDrainTimeout)
+	if drainTimeout <= 0 {
+		err := fmt.Errorf("%s must be positive", common.ConfigKeyDrainTimeout)
+		logger.Error("Failed to read drain timeout", zap.Any("error", err))
+		panic(err)
+	}
+
+	if err := _state.SetDrainTimeout(time.Duration(drainTimeout * float64(time.Second))); err != nil {
+		logger.Error("Failed to set drain timeout", zap.Any("error", err))
+		panic(err)
+	}
+
 	if err := _state.SetWWWPath(*wwwPathFlag); err != nil {
 		logger.Error("Failed to set www path", zap.Any("error", err), zap.String("wwwpath", *wwwPathFlag))
 		panic(err)
@@ -112,30 +306,135 @@ func init() {
 		panic(err)
 	}
 
-	_state.OnGatewayPortChange(func(port string) error {
-		config.Set(common.ConfigKeyGatewayPort, port)
-		return config.WriteConfig()
+	_state.AddPortChangeStep(service.PortChangeStep{
+		Name: "config",
+		Prepare: func(port string) error {
+			previous := config.GetString(common.ConfigKeyGatewayPort)
+
+			config.Set(common.ConfigKeyGatewayPort, port)
+			if err := config.WriteConfig(); err != nil {
+				config.Set(common.ConfigKeyGatewayPort, previous)
+				return err
+			}
+
+			return nil
+		},
+		Rollback: func(previous string) error {
+			config.Set(common.ConfigKeyGatewayPort, previous)
+			return config.WriteConfig()
+		},
+	})
+
+	// options that can be changed in gateway.ini without restarting - reloaded into an instance of their own, as viper
+	// is not safe for concurrent use, and `config` is still written by port changes
+	watched, err := common.LoadConfig()
+	if err != nil {
+		logger.Error("Failed to load config to watch", zap.Any("error", err))
+		panic(err)
+	}
+
+	watched.OnConfigChange(func(event fsnotify.Event) {
+		logger.Info("Config file changed - reloading", zap.Any("event", event.String()))
+
+		if err := _state.SetCORSOptions(corsOptionsFrom(watched)); err != nil {
+			logger.Error("Failed to reload CORS options", zap.Any("error", err))
+		}
 	})
+	watched.WatchConfig()
 }
 
 func main() {
-	pidFilename, err := writePidFile(_state.GetRuntimePath())
+	var err error
+	if _upgrade, err = service.UpgradeFromEnv(); err != nil {
+		logger.Error("Failed to take over from previous process", zap.Any("error", err))
+		panic(err)
+	}
+
+	// sockets from systemd, if the gateway is socket activated - otherwise it listens on its own
+	if files := activation.Files(true); len(files) > 0 {
+		if err := _upgrade.Listeners.Activate(files); err != nil {
+			logger.Error("Failed to take over sockets from systemd", zap.Any("error", err))
+			panic(err)
+		}
+	}
+
+	if addresses := _upgrade.Listeners.ActivatedAddresses(); len(addresses) > 0 {
+		if err := _state.SetListenAddresses(addresses); err != nil {
+			logger.Error("Failed to listen on sockets from systemd", zap.Any("error", err))
+			panic(err)
+		}
+
+		// what is served, instead of the port in the config, which is left as it is - the configured one if there is a
+		// socket on it, otherwise the first socket
+		port := addresses[0].Port
+		for _, address := range addresses {
+			if address.Port == _state.GetGatewayPort() {
+				port = address.Port
+			}
+		}
+		_state.SetActivatedGatewayPort(port)
+
+		logger.Info("Gateway is socket activated - listen addresses are the sockets from systemd", zap.Any("addresses", addresses), zap.String("port", port))
+	}
+
+	// the previous process writes it once this one is ready to take over
+	if !_upgrade.Upgrading() {
+		if err := writePidFile(_state.GetRuntimePath(), os.Getpid()); err != nil {
+			logger.Error("Failed to write pid file to runtime path", zap.Any("error", err), zap.Any("runtimePath", _state.GetRuntimePath()))
+			panic(err)
+		}
+	}
+
+	filenames := []string{pidFilename, external.ManagementURLFilename, external.StaticURLFilename}
+	if _state.GetManagementOptions().UnixSocket != "" {
+		filenames = append(filenames, common.ManagementUnixURLFilename)
+
+		// systemd owns the socket file if it passed the socket
+		if !_upgrade.Listeners.Activated(service.ListenerManagementUnix) {
+			filenames = append(filenames, common.ManagementSocketFilename)
+		}
+	}
+	if _state.GetManagementOptions().TLSAddress != "" {
+		filenames = append(filenames, common.ManagementTLSURLFilename)
+	}
+
+	defer func() {
+		if !_upgraded.Load() {
+			cleanupFiles(_state.GetRuntimePath(), filenames...)
+		}
+	}()
+
+	tracing, err := service.NewTracing(_state)
 	if err != nil {
-		logger.Error("Failed to write pid file to runtime path", zap.Any("error", err), zap.Any("runtimePath", _state.GetRuntimePath()))
+		logger.Error("Failed to set up tracing", zap.Any("error", err), zap.Any("endpoint", _state.GetTracingOptions().Endpoint))
 		panic(err)
 	}
 
-	defer cleanupFiles(
-		_state.GetRuntimePath(),
-		pidFilename, external.ManagementURLFilename, external.StaticURLFilename,
-	)
+	// after the gateway is stopped, to export the spans of its last requests
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := tracing.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to export remaining spans", zap.Any("error", err))
+		}
+	}()
 
 	defer func() {
-		if _gateway != nil {
-			if err := _gateway.Shutdown(context.Background()); err != nil {
-				logger.Error("Failed to stop gateway", zap.Any("error", err))
-			}
+		_gatewaysMutex.Lock()
+		defer _gatewaysMutex.Unlock()
+
+		for address, gateway := range _gateways {
+			drainGateway(address, gateway)
 		}
+
+		_serversMutex.Lock()
+		for name, server := range _servers {
+			drainServer(name, server)
+		}
+		_serversMutex.Unlock()
+
+		_draining.Wait()
 	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -147,10 +446,45 @@ func main() {
 		cancel()
 	}()
 
+	ready := make(chan struct{})
+
+	// a new binary takes over the listeners, then this process drains and exits
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+
+	go func() {
+		<-ready
+
+		for range upgrade {
+			if err := upgradeProcess(); err != nil {
+				logger.Error("Failed to upgrade - still running", zap.Any("error", err))
+				continue
+			}
+
+			cancel()
+			return
+		}
+	}()
+
 	go func() {
 		<-_managementServiceReady
 		<-_gatewayServiceReady
 
+		// nothing else is taking over the listeners of the previous process
+		_upgrade.Listeners.CloseInherited()
+		close(ready)
+
+		go _watchdog.Run(ctx)
+
+		if _upgrade.Upgrading() {
+			if err := _upgrade.NotifyReady(); err != nil {
+				logger.Error("Failed to notify previous process that gateway is ready", zap.Any("error", err))
+			} else {
+				logger.Info("Notified previous process that gateway is ready to take over")
+			}
+			return
+		}
+
 		if supported, err := daemon.SdNotify(false, daemon.SdNotifyReady); err != nil {
 			logger.Error("Failed to notify systemd that gateway is ready", zap.Any("error", err))
 		} else if supported {
@@ -163,8 +497,15 @@ func main() {
 	app := fx.New(
 		fx.Provide(func() *service.State { return _state }),
 		fx.Provide(service.NewManagementService),
+		fx.Provide(func(management *service.Management) *service.Metrics { return management.Metrics }),
+		fx.Provide(service.NewCertificateStore),
+		fx.Provide(service.NewACMEManager),
+		fx.Provide(service.NewAccessLogger),
+		fx.Provide(func() *service.Tracing { return tracing }),
+		fx.Provide(func() *service.Logging { return _logging }),
 		fx.Provide(route.NewManagementRoute),
 		fx.Provide(route.NewGatewayRoute),
+		fx.Provide(route.NewRedirectRoute),
 		fx.Provide(route.NewStaticRoute),
 		fx.Invoke(run),
 	)
@@ -179,48 +520,82 @@ func main() {
 func run(
 	lifecycle fx.Lifecycle,
 	management *service.Management,
+	metrics *service.Metrics,
+	certificates *service.CertificateStore,
+	acmeManager *service.ACMEManager,
 	managementRoute *route.ManagementRoute,
 	gatewayRoute *route.GatewayRoute,
+	redirectRoute *route.RedirectRoute,
 	staticRoute *route.StaticRoute,
 ) {
+	watchdogTimeout, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		logger.Error("Failed to read systemd watchdog timeout - not keeping it alive", zap.Any("error", err))
+	}
+
+	_watchdog = service.NewWatchdog(watchdogTimeout, sdNotify, func() string {
+		return fmt.Sprintf("Gateway on port %s - %d routes, %.2f requests/s", _state.GetGatewayPort(), len(management.GetRoutes()), management.RequestRate())
+	})
+	_watchdog.SetCheck(service.HealthServerGateway, checkGateways)
+
 	// management server
 	lifecycle.Append(
 		fx.Hook{
 			OnStart: func(context.Context) error {
-				listener, err := net.Listen("tcp", net.JoinHostPort(localhost, "0"))
+				listener, err := _upgrade.Listeners.Listen(service.ListenerManagement, "tcp", net.JoinHostPort(localhost, "0"))
 				if err != nil {
 					return err
 				}
 
-				managementServer := &http.Server{
-					Handler:           managementRoute.GetRoute(),
+				handler := managementRoute.GetRoute()
+
+				managementServer := addServer(service.ListenerManagement, &http.Server{
+					Handler:           handler,
 					ReadHeaderTimeout: 5 * time.Second,
-				}
+				})
 
 				urlFilePath, err := writeAddressFile(_state.GetRuntimePath(), external.ManagementURLFilename, "http://"+listener.Addr().String())
 				if err != nil {
 					return err
 				}
 
+				pingURL := "http://" + listener.Addr().String() + "/ping"
+				_watchdog.SetCheck(service.HealthServerManagement, func() error { return pkg.CheckURL(pingURL) })
+
 				go func() {
 					logger.Info("Management service is listening...",
 						zap.Any("address", listener.Addr().String()),
 						zap.Any("filepath", urlFilePath),
 					)
 					err := managementServer.Serve(listener)
-					if err != nil {
+					if err != nil && !errors.Is(err, http.ErrServerClosed) {
 						logger.Error("management server error", zap.Any("error", err))
 						os.Exit(1)
 					}
 				}()
 
-				if err := management.CreateRoute(&model.Route{
-					Path:   "/v1/gateway/port",
-					Target: "http://" + listener.Addr().String(),
-				}); err != nil {
-					return err
+				if socketPath := _state.GetManagementOptions().UnixSocket; socketPath != "" {
+					if err := startManagementSocket(socketPath, handler); err != nil {
+						return err
+					}
+				}
+
+				if options := _state.GetManagementOptions(); options.TLSAddress != "" {
+					if err := startManagementTLS(options, handler); err != nil {
+						return err
+					}
 				}
 
+				for _, path := range []string{"/v1/gateway/port", "/v1/gateway/tls", "/v1/gateway/audit", "/v1/gateway/inspect", "/v1/gateway/slow", "/v1/gateway/logging"} {
+					if err := management.CreateRoute(&service.Route{
+						Path:   path,
+						Target: "http://" + listener.Addr().String(),
+					}, service.GatewayCaller, false); err != nil {
+						return err
+					}
+				}
+
+				management.Health.SetServerUp(service.HealthServerManagement, true)
 				_managementServiceReady <- struct{}{}
 
 				return nil
@@ -232,49 +607,82 @@ func run(
 	lifecycle.Append(
 		fx.Hook{
 			OnStart: func(ctx context.Context) error {
-				route := gatewayRoute.GetRoute()
+				route := acmeManager.HTTPHandler(gatewayRoute.GetRoute())
 
 				if _state.GetGatewayPort() == "" {
-					// check if a port is available starting from port 80/8080
-					portsToCheck := []int{}
-					for i := 80; i < 90; i++ {
-						portsToCheck = append(portsToCheck, i)
+					// check if a port is available starting from port 80/8080 (or 443/8443 for HTTPS)
+					portsToCheck := httpPortsToCheck()
+					if _state.GetTLSOptions().Enabled {
+						portsToCheck = httpsPortsToCheck()
 					}
 
-					for i := 8080; i < 8090; i++ {
-						portsToCheck = append(portsToCheck, i)
+					port, err := findAvailablePort(portsToCheck)
+					if err != nil {
+						return err
 					}
 
-					port := ""
-					for _, p := range portsToCheck {
-						port = fmt.Sprintf("%d", p)
-						logger.Info("Checking if port is available...", zap.Any("port", port))
-						if listener, err := net.Listen("tcp", net.JoinHostPort("", port)); err == nil {
-							if err = listener.Close(); err != nil {
-								logger.Error("Failed to close listener", zap.Any("error", err), zap.Any("port", port))
-								continue
-							}
-							break
-						}
+					if err := _state.SetGatewayPort(port); err != nil {
+						return err
 					}
+				}
 
-					if port == "" {
-						return errors.New("No port available for gateway to use")
+				var tlsConfig *tls.Config
+				if _state.GetTLSOptions().Enabled {
+					if err := certificates.Watch(); err != nil {
+						return err
 					}
 
-					if err := _state.SetGatewayPort(port); err != nil {
-						return err
+					if _state.GetACMEOptions().Enabled {
+						certificates.AddSource(acmeManager)
 					}
+
+					tlsConfig = certificates.TLSConfig()
 				}
 
-				_state.OnGatewayPortChange(func(port string) error {
-					return reloadGateway(port, route)
+				// the new gateways start alongside the old ones, which stop only once the port change is committed
+				_state.AddPortChangeStep(service.PortChangeStep{
+					Name: "gateway",
+					Prepare: func(port string) error {
+						if err := sdNotify(service.WatchdogReloading); err != nil {
+							logger.Error("Failed to notify systemd that gateway is reloading", zap.Any("error", err))
+						}
+
+						err := startGateways(port, route, tlsConfig)
+						if err != nil {
+							metrics.ObserveReload(err)
+							notifyReady()
+						}
+
+						return err
+					},
+					Commit: func(port string) {
+						stopGateways(port)
+						metrics.ObserveReload(nil)
+						notifyReady()
+					},
+					Rollback: func(previous string) error {
+						stopGateways(previous)
+						metrics.ObserveReload(service.ErrPortChange)
+						notifyReady()
+						return nil
+					},
 				})
 
-				if err := reloadGateway(_state.GetGatewayPort(), route); err != nil {
+				// first, to answer ACME HTTP-01 challenges as soon as the gateway starts
+				if err := startPlainHTTP(acmeManager, redirectRoute.GetRoute(route)); err != nil {
 					return err
 				}
 
+				if err := startGateways(_state.GetGatewayPort(), route, tlsConfig); err != nil {
+					return err
+				}
+
+				// once both challenges can be answered
+				if _state.GetTLSOptions().Enabled && _state.GetACMEOptions().Enabled {
+					acmeManager.Start()
+				}
+
+				management.Health.SetServerUp(service.HealthServerGateway, true)
 				_gatewayServiceReady <- struct{}{}
 
 				return nil
@@ -284,15 +692,15 @@ func run(
 	// static web
 	lifecycle.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
-			listener, err := net.Listen("tcp", net.JoinHostPort(localhost, "0"))
+			listener, err := _upgrade.Listeners.Listen(service.ListenerStatic, "tcp", net.JoinHostPort(localhost, "0"))
 			if err != nil {
 				return err
 			}
 
-			staticServer := &http.Server{
+			staticServer := addServer(service.ListenerStatic, &http.Server{
 				Handler:           staticRoute.GetRoute(),
 				ReadHeaderTimeout: 5 * time.Second,
-			}
+			})
 
 			target := "http://" + listener.Addr().String()
 
@@ -301,10 +709,14 @@ func run(
 				return err
 			}
 
-			if err := management.CreateRoute(&model.Route{
-				Path:   "/",
-				Target: target,
-			}); err != nil {
+			// security headers are added by the gateway in front, with any override of this route - which is kept, as
+			// only the address of the static web changes
+			route := &service.Route{Path: "/", Target: target}
+			if existing, _ := management.Match("/"); existing != nil && existing.Path == "/" {
+				route.Headers = existing.Headers
+			}
+
+			if err := management.CreateRoute(route, service.GatewayCaller, false); err != nil {
 				return err
 			}
 
@@ -313,102 +725,415 @@ func run(
 				zap.Any("address", listener.Addr().String()),
 				zap.Any("filepath", urlFilePath),
 			)
+			management.Health.SetServerUp(service.HealthServerStatic, true)
+			defer management.Health.SetServerUp(service.HealthServerStatic, false)
+
 			return staticServer.Serve(listener)
 		},
 	})
 }
 
-func reloadGateway(port string, route *http.ServeMux) error {
-	listener, err := net.Listen("tcp", net.JoinHostPort("", port))
+// Start a gateway at each listen address for `port`, unless there is one already, alongside the gateways at other
+// addresses. If any fails to start, the ones started are closed again.
+func startGateways(port string, route http.Handler, tlsConfig *tls.Config) error {
+	_gatewaysMutex.Lock()
+	defer _gatewaysMutex.Unlock()
+
+	started := make(map[string]*service.Server)
+
+	for _, listenAddress := range _state.GetListenAddresses() {
+		address := listenAddress.Address(port)
+
+		if _, ok := _gateways[address]; ok || started[address] != nil {
+			continue
+		}
+
+		gateway, err := startGateway(address, route, tlsConfig)
+		if err != nil {
+			for startedAddress, startedGateway := range started {
+				_upgrade.Listeners.Forget(service.GatewayListenerName(startedAddress))
+				if err := startedGateway.Close(); err != nil {
+					logger.Error("Error when closing a new gateway", zap.Any("error", err), zap.Any("address", startedAddress))
+				}
+			}
+			return err
+		}
+
+		started[address] = gateway
+	}
+
+	if len(started) == 0 {
+		logger.Info("Port is the same as current running gateway - no change is required")
+		return nil
+	}
+
+	for address, gateway := range started {
+		_gateways[address] = gateway
+	}
+
+	return nil
+}
+
+// Stop the gateways at addresses other than the listen addresses for `port`, e.g. the previous port once the port
+// change is committed, or the new port when it is rolled back.
+func stopGateways(port string) {
+	_gatewaysMutex.Lock()
+	defer _gatewaysMutex.Unlock()
+
+	addresses := make(map[string]bool)
+	for _, listenAddress := range _state.GetListenAddresses() {
+		addresses[listenAddress.Address(port)] = true
+	}
+
+	for address, gateway := range _gateways {
+		if addresses[address] {
+			continue
+		}
+
+		delete(_gateways, address)
+
+		logger.Info("Stopping gateway...", zap.Any("address", address))
+		drainGateway(address, gateway)
+	}
+}
+
+// Let `gateway` finish its requests in flight, up to the drain timeout, then stop it.
+func drainGateway(address string, gateway *service.Server) {
+	drainServer(service.GatewayListenerName(address), gateway)
+}
+
+// Keep track of a server other than the gateways, to drain it when the process exits.
+func addServer(name string, server *http.Server) *service.Server {
+	_serversMutex.Lock()
+	defer _serversMutex.Unlock()
+
+	_servers[name] = service.NewServer(server)
+	return _servers[name]
+}
+
+// Stop the server with the listener `name`, after it finishes its requests in flight or the drain timeout.
+func drainServer(name string, server *service.Server) {
+	// closed by the drain, so not to be passed on
+	_upgrade.Listeners.Forget(name)
+
+	_draining.Add(1)
+	go func() {
+		defer _draining.Done()
+
+		if err := server.Drain(_state.GetDrainTimeout()); err != nil {
+			logger.Error("Error when stopping a server", zap.Any("error", err), zap.Any("name", name))
+		}
+	}()
+}
+
+// Start a new process of the executable, which may be a new version, with the listeners of this one. Once it is ready,
+// it takes over the pid file and systemd, and this process can drain and exit.
+func upgradeProcess() error {
+	logger.Info("Upgrading - starting new process...")
+
+	// the new process reads the routes and the port as they are now, so any change after would be lost with this one -
+	// until it takes over, clients get 503 to try again
+	_state.SuspendWrites()
+
+	// no port change while the listeners are passed on
+	_gatewaysMutex.Lock()
+	process, err := _upgrade.Start(service.UpgradeTimeout)
+	_gatewaysMutex.Unlock()
+
 	if err != nil {
+		_state.ResumeWrites()
 		return err
 	}
 
-	addr := listener.Addr().String()
+	if err := writePidFile(_state.GetRuntimePath(), process.Pid); err != nil {
+		logger.Error("Failed to write pid file of new process", zap.Any("error", err), zap.Int("pid", process.Pid))
+	}
 
-	if _gateway != nil && _gateway.Addr == addr {
-		logger.Info("Port is the same as current running gateway - no change is required")
-		return nil
+	if _, err := daemon.SdNotify(false, fmt.Sprintf("MAINPID=%d", process.Pid)); err != nil {
+		logger.Error("Failed to notify systemd of new main process", zap.Any("error", err), zap.Int("pid", process.Pid))
+	}
+
+	_upgraded.Store(true)
+
+	logger.Info("New process has taken over - draining and exiting", zap.Int("pid", process.Pid))
+
+	return nil
+}
+
+// Start a gateway listening at `address`, and wait for it to respond.
+func startGateway(address string, route http.Handler, tlsConfig *tls.Config) (*service.Server, error) {
+	listener, err := _upgrade.Listeners.Listen(service.GatewayListenerName(address), "tcp", address)
+	if err != nil {
+		return nil, err
 	}
 
-	// start new gateway
-	gatewayNew := &http.Server{
+	addr := listener.Addr().String()
+
+	gateway := service.NewServer(&http.Server{
 		Addr:              addr,
 		Handler:           route,
 		ReadHeaderTimeout: 5 * time.Second,
-	}
+		TLSConfig:         tlsConfig,
+	})
 
 	go func() {
-		err := gatewayNew.Serve(listener)
-		if err != nil {
+		if err := gateway.Serve(listener); err != nil {
 			if errors.Is(err, http.ErrServerClosed) {
-				logger.Info("A gateway is stopped", zap.Any("address", gatewayNew.Addr))
+				logger.Info("A gateway is stopped", zap.Any("address", addr))
 				return
 			}
-			logger.Error("Error when serving a gateway", zap.Any("error", err), zap.Any("address", gatewayNew.Addr))
+			logger.Error("Error when serving a gateway", zap.Any("error", err), zap.Any("address", addr))
 		}
 	}()
 
 	// test if gateway is running
-	url := "http://" + addr + "/ping"
-	if err := checkURLWithRetry(url, 10); err != nil {
+	if err := pkg.CheckURLWithRetry(gatewayPingURL(gateway), 10); err != nil {
+		_upgrade.Listeners.Forget(service.GatewayListenerName(address))
+		_ = gateway.Close()
+		return nil, err
+	}
+
+	logger.Info("New gateway is listening...", zap.Any("address", addr))
+
+	return gateway, nil
+}
+
+// Serve the management API on a Unix socket as well, so that services on this machine can be authorized by their
+// uid/gid instead of a JWT.
+func startManagementSocket(socketPath string, handler http.Handler) error {
+	// left behind if the gateway did not exit cleanly last time, unless it is passed on by the previous process
+	if !_upgrade.Listeners.Inherited(service.ListenerManagementUnix) {
+		if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	listener, err := _upgrade.Listeners.Listen(service.ListenerManagementUnix, "unix", socketPath)
+	if err != nil {
+		return err
+	}
+
+	if _upgrade.Listeners.Activated(service.ListenerManagementUnix) {
+		// wherever the socket unit puts it, with its `SocketMode=`
+		socketPath = listener.Addr().String()
+	} else if err := os.Chmod(socketPath, 0o666); err != nil { // #nosec G302
+		// anyone can connect - peers are authorized per request by their credentials, and the rest still need a JWT.
 		return err
 	}
 
-	logger.Info("New gateway is listening...", zap.Any("address", gatewayNew.Addr))
+	socketServer := addServer(service.ListenerManagementUnix, &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ConnContext:       route.WithPeerCredentials,
+	})
 
-	// stop old gateway
-	if _gateway != nil {
-		gatewayOld := _gateway
-		go func() {
-			logger.Info("Stopping previous gateway in 1 seconds...", zap.Any("address", gatewayOld.Addr))
-			time.Sleep(time.Second) // so that any request to the old gateway gets a response
-			if err := gatewayOld.Shutdown(context.Background()); err != nil {
-				logger.Error("Error when stopping previous gateway", zap.Any("error", err), zap.Any("address", gatewayOld.Addr))
-			}
-		}()
+	urlFilePath, err := writeAddressFile(_state.GetRuntimePath(), common.ManagementUnixURLFilename, "unix://"+socketPath)
+	if err != nil {
+		return err
 	}
 
-	_gateway = gatewayNew
+	go func() {
+		logger.Info("Management service is listening on Unix socket...",
+			zap.Any("address", socketPath),
+			zap.Any("filepath", urlFilePath),
+		)
+		if err := socketServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error when serving management service on Unix socket", zap.Any("error", err), zap.Any("address", socketPath))
+		}
+	}()
 
 	return nil
 }
 
-func checkURLWithRetry(url string, retry uint) error {
-	count := retry
-	var err error
+// Serve the management API with mTLS as well, for services on other hosts or in containers that cannot reach loopback.
+func startManagementTLS(options service.ManagementOptions, handler http.Handler) error {
+	tlsConfig, err := options.TLSConfig()
+	if err != nil {
+		return err
+	}
 
-	for count >= 0 {
-		logger.Info("Checking if service at URL is running...", zap.Any("url", url), zap.Any("retry", count))
-		if err = checkURL(url); err != nil {
-			time.Sleep(time.Second)
-			count--
-			continue
+	listener, err := _upgrade.Listeners.Listen(service.ListenerManagementTLS, "tcp", options.TLSAddress)
+	if err != nil {
+		return err
+	}
+
+	tlsServer := addServer(service.ListenerManagementTLS, &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		TLSConfig:         tlsConfig,
+	})
+
+	urlFilePath, err := writeAddressFile(_state.GetRuntimePath(), common.ManagementTLSURLFilename, "https://"+listener.Addr().String())
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logger.Info("Management service is listening with mTLS...",
+			zap.Any("address", listener.Addr().String()),
+			zap.Any("filepath", urlFilePath),
+		)
+		if err := tlsServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error when serving management service with mTLS", zap.Any("error", err), zap.Any("address", listener.Addr().String()))
+		}
+	}()
+
+	return nil
+}
+
+// Start a plain HTTP server at `port` that redirects to HTTPS. If `port` is empty, the first available one from 80/8080
+// is used.
+// Start the plain HTTP listener next to the TLS gateway, if there is one - to redirect to HTTPS (`redirect`), and to
+// answer ACME HTTP-01 challenges, which are only ever validated on port 80.
+func startPlainHTTP(acmeManager *service.ACMEManager, redirect http.Handler) error {
+	options := _state.GetTLSOptions()
+	if !options.Enabled {
+		return nil
+	}
+
+	acmeOptions := _state.GetACMEOptions()
+	http01 := acmeOptions.Enabled && acmeOptions.UsesChallenge(service.ChallengeHTTP01)
+
+	switch {
+	case http01:
+		// `httpport` is still respected, e.g. for a router forwarding port 80 to it - but never another free port
+		port := options.HTTPPort
+		if port == "" {
+			port = "80"
+		}
+
+		handler, description := http.NotFoundHandler(), "HTTP for ACME challenges"
+		if options.RedirectHTTP {
+			handler, description = redirect, "HTTP to HTTPS redirect"
+		}
+
+		if err := startRedirect(port, acmeManager.HTTPHandler(handler), description); err != nil {
+			return fmt.Errorf("ACME %s challenges need plain HTTP on port %s - free the port, or remove %s from %s: %w", service.ChallengeHTTP01, port, service.ChallengeHTTP01, common.ConfigKeyACMEChallenges, err)
+		}
+
+	case options.RedirectHTTP:
+		if err := startRedirect(options.HTTPPort, redirect, "HTTP to HTTPS redirect"); err != nil {
+			return err
 		}
-		break
 	}
 
-	return err
+	return nil
 }
 
-func checkURL(url string) error {
-	response, err := http2.Get(url, 5*time.Second)
-	if err == nil {
+func startRedirect(port string, handler http.Handler, description string) error {
+	if port == "" && !_upgrade.Listeners.Inherited(service.ListenerRedirect) {
+		var err error
+		if port, err = findAvailablePort(httpPortsToCheck()); err != nil {
+			return err
+		}
+	}
+
+	listener, err := _upgrade.Listeners.Listen(service.ListenerRedirect, "tcp", net.JoinHostPort("", port))
+	if err != nil {
 		return err
 	}
-	defer response.Body.Close()
 
-	if response.StatusCode == http.StatusOK {
-		return ErrCheckURLNotOK
+	redirectServer := addServer(service.ListenerRedirect, &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	})
+
+	go func() {
+		logger.Info(description+" is listening...", zap.Any("address", listener.Addr().String()))
+		if err := redirectServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Error when serving "+description, zap.Any("error", err), zap.Any("address", listener.Addr().String()))
+		}
+	}()
+
+	return nil
+}
+
+func httpPortsToCheck() []int {
+	portsToCheck := []int{}
+	for i := 80; i < 90; i++ {
+		portsToCheck = append(portsToCheck, i)
+	}
+
+	for i := 8080; i < 8090; i++ {
+		portsToCheck = append(portsToCheck, i)
+	}
+
+	return portsToCheck
+}
+
+func httpsPortsToCheck() []int {
+	portsToCheck := []int{443}
+	for i := 8443; i < 8453; i++ {
+		portsToCheck = append(portsToCheck, i)
+	}
+
+	return portsToCheck
+}
+
+// returns the first port from `portsToCheck` that is available to listen on
+func findAvailablePort(portsToCheck []int) (string, error) {
+	for _, p := range portsToCheck {
+		port := fmt.Sprintf("%d", p)
+		logger.Info("Checking if port is available...", zap.Any("port", port))
+		if listener, err := net.Listen("tcp", net.JoinHostPort("", port)); err == nil {
+			if err = listener.Close(); err != nil {
+				logger.Error("Failed to close listener", zap.Any("error", err), zap.Any("port", port))
+				continue
+			}
+			return port, nil
+		}
+	}
+
+	return "", errors.New("No port available for gateway to use")
+}
+
+func gatewayPingURL(gateway *service.Server) string {
+	scheme := "http"
+	if gateway.TLS() {
+		scheme = "https"
+	}
+
+	// with the zone of an IPv6 link-local address escaped
+	return (&url.URL{Scheme: scheme, Host: gateway.Addr, Path: "/ping"}).String()
+}
+
+// Every gateway still responds, for the watchdog.
+func checkGateways() error {
+	_gatewaysMutex.Lock()
+	gateways := make([]*service.Server, 0, len(_gateways))
+	for _, gateway := range _gateways {
+		gateways = append(gateways, gateway)
+	}
+	_gatewaysMutex.Unlock()
+
+	if len(gateways) == 0 {
+		return errors.New("no gateway is running")
+	}
+
+	for _, gateway := range gateways {
+		if err := pkg.CheckURL(gatewayPingURL(gateway)); err != nil {
+			return fmt.Errorf("gateway at %s: %w", gateway.Addr, err)
+		}
 	}
 
 	return nil
 }
 
-func writePidFile(runtimePath string) (string, error) {
-	filename := "gateway.pid"
-	filepath := filepath.Join(runtimePath, filename)
-	return filename, os.WriteFile(filepath, []byte(fmt.Sprintf("%d", os.Getpid())), 0o600)
+// after reloading, whether or not the port changed
+func notifyReady() {
+	if err := sdNotify(service.WatchdogReady); err != nil {
+		logger.Error("Failed to notify systemd that gateway is ready", zap.Any("error", err))
+	}
+}
+
+// Send `state` to systemd, if the gateway runs as a systemd service.
+func sdNotify(state string) error {
+	_, err := daemon.SdNotify(false, state)
+	return err
+}
+
+func writePidFile(runtimePath string, pid int) error {
+	return writeFileAtomically(filepath.Join(runtimePath, pidFilename), []byte(strconv.Itoa(pid)))
 }
 
 func writeAddressFile(runtimePath string, filename string, address string) (string, error) {
@@ -418,7 +1143,28 @@ func writeAddressFile(runtimePath string, filename string, address string) (stri
 	}
 
 	filepath := filepath.Join(runtimePath, filename)
-	return filepath, os.WriteFile(filepath, []byte(address), 0o600)
+	return filepath, writeFileAtomically(filepath, []byte(address))
+}
+
+// Write to a temporary file next to `path` and rename it, so that a reader never sees it partly written, e.g. by
+// the previous process during an upgrade.
+func writeFileAtomically(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // nolint: errcheck - already gone once renamed
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), path)
 }
 
 func cleanupFiles(runtimePath string, filenames ...string) {
@@ -440,3 +1186,165 @@ func checkPrequisites(state *service.State) error {
 
 	return nil
 }
+
+func tlsOptionsFrom(config *viper.Viper) (service.TLSOptions, error) {
+	options := service.TLSOptions{
+		Enabled:      config.GetBool(common.ConfigKeyTLSEnabled),
+		Certificates: make([]service.CertificateFiles, 0),
+		RedirectHTTP: config.GetBool(common.ConfigKeyTLSRedirectHTTP),
+		HTTPPort:     config.GetString(common.ConfigKeyTLSHTTPPort),
+	}
+
+	if config.GetBool(common.ConfigKeyTLSSelfSigned) {
+		options.SelfSignedPath = config.GetString(common.ConfigKeyTLSSelfSignedPath)
+	}
+
+	if certFile := config.GetString(common.ConfigKeyTLSCertFile); certFile != "" {
+		options.Certificates = append(options.Certificates, service.CertificateFiles{
+			CertFile: certFile,
+			KeyFile:  config.GetString(common.ConfigKeyTLSKeyFile),
+		})
+	}
+
+	// additional certificates, as `certfile:keyfile` pairs
+	for _, pair := range common.GetStringList(config, common.ConfigKeyTLSCertificates) {
+		certFile, keyFile, found := strings.Cut(pair, ":")
+		if !found {
+			return options, fmt.Errorf("invalid certificate `%s` in %s - expected `certfile:keyfile`", pair, common.ConfigKeyTLSCertificates)
+		}
+
+		options.Certificates = append(options.Certificates, service.CertificateFiles{
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		})
+	}
+
+	if options.Enabled && len(options.Certificates) == 0 && options.SelfSignedPath == "" && !config.GetBool(common.ConfigKeyACMEEnabled) {
+		return options, fmt.Errorf("TLS is enabled but no certificate is configured in %s, and neither %s nor %s is on", common.ConfigKeyTLSCertFile, common.ConfigKeyTLSSelfSigned, common.ConfigKeyACMEEnabled)
+	}
+
+	return options, nil
+}
+
+func acmeOptionsFrom(config *viper.Viper) (service.ACMEOptions, error) {
+	options := service.ACMEOptions{
+		Enabled:      config.GetBool(common.ConfigKeyACMEEnabled),
+		Domains:      common.GetStringList(config, common.ConfigKeyACMEDomains),
+		Email:        config.GetString(common.ConfigKeyACMEEmail),
+		DirectoryURL: config.GetString(common.ConfigKeyACMEDirectoryURL),
+		CARootFile:   config.GetString(common.ConfigKeyACMECARootFile),
+		Challenges:   common.GetStringList(config, common.ConfigKeyACMEChallenges),
+		Path:         config.GetString(common.ConfigKeyACMEPath),
+		RenewBefore:  time.Duration(config.GetInt(common.ConfigKeyACMERenewBeforeDays)) * 24 * time.Hour,
+	}
+
+	if !options.Enabled {
+		return options, nil
+	}
+
+	if !config.GetBool(common.ConfigKeyTLSEnabled) {
+		return options, fmt.Errorf("ACME is enabled but TLS is not - set %s to true", common.ConfigKeyTLSEnabled)
+	}
+
+	if len(options.Domains) == 0 {
+		return options, fmt.Errorf("ACME is enabled but no domain is configured in %s", common.ConfigKeyACMEDomains)
+	}
+
+	for _, challenge := range options.Challenges {
+		if challenge != service.ChallengeHTTP01 && challenge != service.ChallengeTLSALPN01 {
+			return options, fmt.Errorf("unsupported ACME challenge `%s` in %s", challenge, common.ConfigKeyACMEChallenges)
+		}
+	}
+
+	return options, nil
+}
+
+func corsOptionsFrom(config *viper.Viper) service.CORSOptions {
+	return service.CORSOptions{
+		AllowOrigins:     common.GetStringList(config, common.ConfigKeyCORSAllowOrigins),
+		AllowMethods:     common.GetStringList(config, common.ConfigKeyCORSAllowMethods),
+		AllowHeaders:     common.GetStringList(config, common.ConfigKeyCORSAllowHeaders),
+		AllowCredentials: config.GetBool(common.ConfigKeyCORSAllowCredentials),
+		MaxAge:           config.GetInt(common.ConfigKeyCORSMaxAge),
+	}
+}
+
+func managementOptionsFrom(config *viper.Viper, runtimePath string) (service.ManagementOptions, error) {
+	options := service.ManagementOptions{
+		LoopbackBypass: config.GetBool(common.ConfigKeyManagementLoopbackBypass),
+		Admins:         common.GetStringList(config, common.ConfigKeyManagementAdmins),
+	}
+
+	if config.GetBool(common.ConfigKeyManagementUnixSocket) {
+		options.UnixSocket = filepath.Join(runtimePath, common.ManagementSocketFilename)
+	}
+
+	if options.TLSAddress = config.GetString(common.ConfigKeyManagementTLSAddress); options.TLSAddress != "" {
+		options.Certificate = service.CertificateFiles{
+			CertFile: config.GetString(common.ConfigKeyManagementCertFile),
+			KeyFile:  config.GetString(common.ConfigKeyManagementKeyFile),
+		}
+		options.ClientCAFile = config.GetString(common.ConfigKeyManagementClientCAFile)
+
+		if options.Certificate.CertFile == "" || options.Certificate.KeyFile == "" || options.ClientCAFile == "" {
+			return options, fmt.Errorf("%s is set but %s, %s or %s is not", common.ConfigKeyManagementTLSAddress, common.ConfigKeyManagementCertFile, common.ConfigKeyManagementKeyFile, common.ConfigKeyManagementClientCAFile)
+		}
+	}
+
+	var err error
+
+	if options.AllowUIDs, err = idsFrom(config, common.ConfigKeyManagementAllowUIDs); err != nil {
+		return options, err
+	}
+
+	if options.AllowGIDs, err = idsFrom(config, common.ConfigKeyManagementAllowGIDs); err != nil {
+		return options, err
+	}
+
+	return options, nil
+}
+
+func idsFrom(config *viper.Viper, key string) ([]uint32, error) {
+	ids := make([]uint32, 0)
+
+	for _, value := range common.GetStringList(config, key) {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id `%s` in %s - expected a number", value, key)
+		}
+
+		ids = append(ids, uint32(id))
+	}
+
+	return ids, nil
+}
+
+func accessLogOptionsFrom(config *viper.Viper) (service.AccessLogOptions, error) {
+	options := service.AccessLogOptions{
+		Enabled: config.GetBool(common.ConfigKeyAccessLogEnabled),
+		Format:  config.GetString(common.ConfigKeyAccessLogFormat),
+
+		// next to the log, e.g. /var/log/casaos/gateway-access.log
+		Filename: filepath.Join(
+			config.GetString(common.ConfigKeyLogPath),
+			config.GetString(common.ConfigKeyLogSaveName)+"-access."+config.GetString(common.ConfigKeyLogFileExt),
+		),
+		MaxSize:    config.GetInt(common.ConfigKeyAccessLogMaxSize),
+		MaxBackups: config.GetInt(common.ConfigKeyAccessLogMaxBackups),
+		MaxAge:     config.GetInt(common.ConfigKeyAccessLogMaxAge),
+		SampleRate: config.GetFloat64(common.ConfigKeyAccessLogSampleRate),
+	}
+
+	switch options.Format {
+	case service.AccessLogFormatCommon, service.AccessLogFormatCombined, service.AccessLogFormatJSON:
+	default:
+		return options, fmt.Errorf("unsupported access log format `%s` in %s - expected %s, %s or %s", options.Format, common.ConfigKeyAccessLogFormat,
+			service.AccessLogFormatCommon, service.AccessLogFormatCombined, service.AccessLogFormatJSON)
+	}
+
+	if options.SampleRate < 0 || options.SampleRate > 1 {
+		return options, fmt.Errorf("%s must be between 0 and 1", common.ConfigKeyAccessLogSampleRate)
+	}
+
+	return options, nil
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+var ErrCheckURLNotOK = errors.New("check url did not return 200 OK")
+
+// how long to wait before checking again
+var checkURLRetryInterval = time.Second
+
+// Check `url` until it returns 200 OK, up to `retry` more times after the first.
+func CheckURLWithRetry(url string, retry uint) error {
+	var err error
+
+	for i := uint(0); i <= retry; i++ {
+		if i > 0 {
+			time.Sleep(checkURLRetryInterval)
+		}
+
+		logger.Info("Checking if service at URL is running...", zap.Any("url", url), zap.Any("retry", retry-i))
+		if err = CheckURL(url); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func CheckURL(url string) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			// the certificate may not be valid for the address being checked, which is fine for checking ourselves.
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402
+		},
+	}
+	defer client.CloseIdleConnections()
+
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return ErrCheckURLNotOK
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"gotest.tools/v3/assert"
+)
+
+func TestCheckURLWithRetry(t *testing.T) {
+	logger.LogInitConsoleOnly()
+
+	checkURLRetryInterval = time.Millisecond
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+
+	assert.NilError(t, CheckURLWithRetry(ok.URL, 3))
+
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+
+	assert.Assert(t, errors.Is(CheckURLWithRetry(notFound.URL, 3), ErrCheckURLNotOK))
+
+	// nothing listening - gives up rather than retrying forever
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	dead := "http://" + listener.Addr().String() + "/ping"
+	listener.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- CheckURLWithRetry(dead, 3) }()
+
+	select {
+	case err := <-done:
+		assert.Assert(t, err != nil)
+	case <-time.After(10 * time.Second):
+		t.Fatal("CheckURLWithRetry did not give up on a dead URL")
+	}
+}
@@ -0,0 +1,143 @@
+package route
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/common_err"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"go.uber.org/zap"
+)
+
+// hop-by-hop headers, which are not passed between the client and the forward auth endpoint
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// headers about the body of the original request, which is not sent to the forward auth endpoint
+var bodyHeaders = []string{"Content-Length", "Content-Type", "Content-Encoding"}
+
+type routeAuthenticator struct {
+	management *service.Management
+	client     *http.Client
+}
+
+func newRouteAuthenticator(management *service.Management) *routeAuthenticator {
+	return &routeAuthenticator{
+		management: management,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+
+			// a redirect (e.g. to a login page) is for the client to follow
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Returns true if the request can go upstream. Otherwise a response is written already.
+func (a *routeAuthenticator) authenticate(route *service.Route, w http.ResponseWriter, r *http.Request) bool {
+	auth := route.Auth
+	if auth == nil {
+		return true
+	}
+
+	if auth.Basic != nil && !a.authenticateBasic(route, w, r) {
+		return false
+	}
+
+	if auth.Forward != nil && !a.authenticateForward(auth.Forward, w, r) {
+		return false
+	}
+
+	return true
+}
+
+func (a *routeAuthenticator) authenticateBasic(route *service.Route, w http.ResponseWriter, r *http.Request) bool {
+	username, password, ok := r.BasicAuth()
+	if ok && a.management.VerifyBasicAuth(route, username, password) {
+		// the app behind does not know about these credentials, so they are not sent to it
+		r.Header.Del("Authorization")
+		return true
+	}
+
+	realm := route.Auth.Basic.Realm
+	if realm == "" {
+		realm = "CasaOS"
+	}
+
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(realm)+", charset=\"UTF-8\"")
+	service.WriteError(w, r, http.StatusUnauthorized, common_err.CLIENT_ERROR, "authentication is required")
+
+	return false
+}
+
+func (a *routeAuthenticator) authenticateForward(forward *service.ForwardAuth, w http.ResponseWriter, r *http.Request) bool {
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodGet, forward.URL, nil)
+	if err != nil {
+		logger.Error("Failed to create forward auth request", zap.Any("error", err), zap.Any("url", forward.URL), zap.String("request_id", service.RequestIDFrom(r.Context())))
+		service.WriteError(w, r, http.StatusInternalServerError, common_err.SERVICE_ERROR, "failed to authenticate")
+		return false
+	}
+
+	request.Header = r.Header.Clone()
+	for _, header := range append(hopHeaders, bodyHeaders...) {
+		request.Header.Del(header)
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	request.Header.Set("X-Forwarded-Method", r.Method)
+	request.Header.Set("X-Forwarded-Proto", scheme)
+	request.Header.Set("X-Forwarded-Host", r.Host)
+	request.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	if request.Header.Get("X-Forwarded-For") == "" {
+		if remoteIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			request.Header.Set("X-Forwarded-For", remoteIP)
+		}
+	}
+
+	response, err := a.client.Do(request)
+	if err != nil {
+		logger.Error("Failed to call forward auth", zap.Any("error", err), zap.Any("url", forward.URL), zap.String("request_id", service.RequestIDFrom(r.Context())))
+		service.WriteError(w, r, http.StatusBadGateway, common_err.SERVICE_ERROR, "failed to authenticate")
+		return false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		for _, header := range forward.ResponseHeaders {
+			r.Header.Del(header)
+			for _, value := range response.Header.Values(header) {
+				r.Header.Add(header, value)
+			}
+		}
+		return true
+	}
+
+	// denied - the client gets the response from the auth endpoint, e.g. a redirect to log in
+	for header, values := range response.Header {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+	for _, header := range hopHeaders {
+		w.Header().Del(header)
+	}
+	w.WriteHeader(response.StatusCode)
+
+	if _, err := io.Copy(w, response.Body); err != nil {
+		logger.Error("Failed to copy forward auth response", zap.Any("error", err), zap.Any("url", forward.URL), zap.String("request_id", service.RequestIDFrom(r.Context())))
+	}
+
+	return false
+}
@@ -1,21 +1,40 @@
 package route
 
 import (
+	"context"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
+	"github.com/IceWhaleTech/CasaOS-Common/utils/common_err"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 type GatewayRoute struct {
-	management *service.Management
+	management    *service.Management
+	accessLogger  *service.AccessLogger
+	tracing       *service.Tracing
+	logging       *service.Logging
+	authenticator *routeAuthenticator
 }
 
-func NewGatewayRoute(management *service.Management) *GatewayRoute {
+func NewGatewayRoute(management *service.Management, accessLogger *service.AccessLogger, tracing *service.Tracing, logging *service.Logging) *GatewayRoute {
 	return &GatewayRoute{
-		management: management,
+		management:    management,
+		accessLogger:  accessLogger,
+		tracing:       tracing,
+		logging:       logging,
+		authenticator: newRouteAuthenticator(management),
 	}
 }
 
@@ -63,7 +82,7 @@ func rewriteRequestSourceIP(r *http.Request) {
 	// So we didn't need to add it.
 }
 
-func (g *GatewayRoute) GetRoute() *http.ServeMux {
+func (g *GatewayRoute) GetRoute() http.Handler {
 	gatewayMux := http.NewServeMux()
 	gatewayMux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/ping" {
@@ -74,19 +93,275 @@ func (g *GatewayRoute) GetRoute() *http.ServeMux {
 			return
 		}
 
-		proxy := g.management.GetProxy(r.URL.Path)
+		route, proxy := g.management.Match(r.URL.Path)
 
 		if proxy == nil {
-			w.WriteHeader(http.StatusNotFound)
+			service.WriteError(w, r, http.StatusNotFound, common_err.CLIENT_ERROR, "no route for "+r.URL.Path)
 			return
 		}
 
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.route = route
+
+			// as the client sent them, before they are rewritten for the target
+			if g.logging.RouteDebugEnabled(route.Path) {
+				info.requestHeader = r.Header.Clone()
+			}
+		}
+
 		// to fix https://github.com/IceWhaleTech/CasaOS/security/advisories/GHSA-32h8-rgcj-2g3c#event-102885
 		// API V1 and V2 both read ip from request header. So the fix is effective for v1 and v2.
 		rewriteRequestSourceIP(r)
 
+		if !g.authenticator.authenticate(route, w, r) {
+			return
+		}
+
 		proxy.ServeHTTP(w, r)
 	})
 
-	return gatewayMux
+	return g.observe(gatewayMux)
+}
+
+// requestInfo is filled in while the gateway mux serves a request, for what happens around it.
+type requestInfo struct {
+	// nil when no route matched
+	route *service.Route
+
+	// only for debug logging
+	requestHeader http.Header
+}
+
+type requestInfoKey struct{}
+
+// attributes of gateway spans that have no semantic convention
+const (
+	tracingAttributeTarget    = attribute.Key("casaos.gateway.target")
+	tracingAttributeRequestID = attribute.Key("casaos.gateway.request_id")
+)
+
+// Give each request an ID and a span, and record metrics, route stats, the access log and the inspector entry for it.
+func (g *GatewayRoute) observe(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics := g.management.Metrics
+
+		done := metrics.RequestStarted()
+		defer done()
+
+		start := time.Now()
+		clientIP := resolveClientIP(r) // before the headers are rewritten for the target
+		info := &requestInfo{}
+		recorder := newResponseRecorder(w)
+
+		body := &bodyCounter{ReadCloser: r.Body}
+		r.Body = body
+
+		// sent to the target, and back to the client
+		requestIDOptions := g.management.State.GetRequestIDOptions()
+		requestID := requestIDOptions.RequestID(r)
+		r.Header.Set(requestIDOptions.Header, requestID)
+		w.Header().Set(requestIDOptions.Header, requestID)
+
+		// the span continues the trace of the client, if any, and the target continues the span
+		propagator := g.tracing.Propagator()
+		ctx, span := g.tracing.Tracer().Start(
+			propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header)),
+			"HTTP "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(r.Method),
+				semconv.HTTPTarget(r.URL.RequestURI()),
+				semconv.HTTPClientIP(clientIP),
+				semconv.NetHostName(r.Host),
+				tracingAttributeRequestID.String(requestID),
+			),
+		)
+		defer span.End()
+
+		propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+		ctx, timer := service.WithUpstreamTimer(ctx)
+		ctx = context.WithValue(service.WithRequestID(ctx, requestID), requestInfoKey{}, info)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		latency := time.Since(start)
+
+		routePath, target := "", ""
+		if info.route != nil {
+			routePath, target = info.route.Path, info.route.Target
+
+			span.SetName(r.Method + " " + routePath)
+			span.SetAttributes(semconv.HTTPRoute(routePath), tracingAttributeTarget.String(target))
+		}
+
+		span.SetAttributes(semconv.HTTPStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+
+		metrics.ObserveRequest(routePath, r.Method, recorder.status, latency)
+
+		if info.route != nil {
+			g.management.ObserveRouteRequest(routePath, recorder.status, body.bytes.Load(), recorder.bytes, latency)
+			g.observeSlowRequest(r, info.route, timer, start.Add(latency), recorder.status, w.Header(), requestID)
+		}
+
+		user, _, _ := r.BasicAuth()
+
+		entry := &service.AccessLogEntry{
+			RequestID: requestID,
+			Time:      start,
+			ClientIP:  clientIP,
+			User:      user,
+			Method:    r.Method,
+			URI:       redactURI(r.RequestURI), // on disk, and streamed by the inspector
+			Proto:     r.Proto,
+			Status:    recorder.status,
+			Bytes:     recorder.bytes,
+			Latency:   latency,
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+			Route:     routePath,
+			Target:    target,
+		}
+
+		g.management.Inspector.Record(entry)
+
+		if g.accessLogger.Enabled(info.route) {
+			g.accessLogger.Log(entry)
+		}
+
+		if info.requestHeader != nil {
+			g.logging.Debug("Request",
+				zap.String("request_id", requestID),
+				zap.String("client_ip", clientIP),
+				zap.String("method", r.Method),
+				zap.String("uri", redactURI(r.RequestURI)),
+				zap.String("route", routePath),
+				zap.String("target", target),
+				zap.Int("status", recorder.status),
+				zap.Int64("bytes_in", body.bytes.Load()),
+				zap.Int64("bytes_out", recorder.bytes),
+				zap.Duration("latency", latency),
+				zap.Any("request_header", redactHeader(info.requestHeader)),
+				zap.Any("response_header", redactHeader(w.Header())),
+			)
+		}
+	})
+}
+
+// Log and count the request if its target took longer than the threshold of `route` to respond, with the response
+// over at `end`.
+func (g *GatewayRoute) observeSlowRequest(r *http.Request, route *service.Route, timer *service.UpstreamTimer, end time.Time, status int, header http.Header, requestID string) {
+	threshold := g.management.SlowRequestThreshold(route)
+	if threshold <= 0 || isStreaming(status, header) {
+		return
+	}
+
+	// not sent to the target, e.g. refused by the auth of the route
+	timing, ok := timer.Timing(end)
+	if !ok || timing.UntilResponse() <= threshold.Seconds() {
+		return
+	}
+
+	uri := redactURI(r.RequestURI)
+
+	logger.Info("Slow request",
+		zap.String("request_id", requestID),
+		zap.String("method", r.Method),
+		zap.String("uri", uri),
+		zap.String("route", route.Path),
+		zap.String("target", route.Target),
+		zap.Int("status", status),
+		zap.Duration("threshold", threshold),
+		zap.Float64("total", timing.Total),
+		zap.Float64("dns", timing.DNS),
+		zap.Float64("dial", timing.Dial),
+		zap.Float64("tls", timing.TLS),
+		zap.Float64("ttfb", timing.TimeToFirstByte),
+		zap.Float64("transfer", timing.Transfer),
+		zap.Bool("reused", timing.Reused),
+	)
+
+	g.management.ObserveSlowRequest(route.Path, threshold, service.SlowRequest{
+		Time:      end,
+		RequestID: requestID,
+		Method:    r.Method,
+		URI:       uri,
+		Status:    status,
+		Timing:    timing,
+	})
+}
+
+// Whether the response is a stream that lasts as long as the client wants, e.g. a WebSocket or server-sent events, even
+// if the target was slow to start it.
+func isStreaming(status int, header http.Header) bool {
+	if status == http.StatusSwitchingProtocols {
+		return true
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// headers with credentials, which are not logged even for debugging
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, name := range sensitiveHeaders {
+		if values := header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = []string{"[redacted]"}
+		}
+	}
+	return header
+}
+
+// query parameters with credentials, e.g. the CasaOS token of a WebSocket, which cannot send it in a header
+var sensitiveQueryParameters = []string{"token", "access_token"}
+
+// `uri` with the values of `sensitiveQueryParameters` redacted, and everything else as it is.
+func redactURI(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+
+	parameters := strings.Split(query, "&")
+	for i, parameter := range parameters {
+		key, _, _ := strings.Cut(parameter, "=")
+		if name, err := url.QueryUnescape(key); err == nil && isSensitiveQueryParameter(name) {
+			parameters[i] = key + "=[redacted]"
+		}
+	}
+
+	return path + "?" + strings.Join(parameters, "&")
+}
+
+func isSensitiveQueryParameter(name string) bool {
+	for _, sensitive := range sensitiveQueryParameters {
+		if strings.EqualFold(name, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// The IP of the client, trusting X-Forwarded-For only from a reverse proxy on loopback, like `rewriteRequestSourceIP`.
+func resolveClientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	if remoteIP != "127.0.0.1" && remoteIP != "::1" {
+		return remoteIP
+	}
+
+	ipList := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if last := strings.TrimSpace(ipList[len(ipList)-1]); last != "" {
+		return last
+	}
+
+	return remoteIP
 }
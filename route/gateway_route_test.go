@@ -0,0 +1,822 @@
+package route
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap/zapcore"
+	"gotest.tools/v3/assert"
+)
+
+func TestRouteAuth(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Upstream-User", r.Header.Get("X-User"))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	authEndpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Redirect(w, r, "http://casaos.local/#/login?redirect="+r.Header.Get("X-Forwarded-Uri"), http.StatusFound)
+			return
+		}
+		w.Header().Set("X-User", "admin")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authEndpoint.Close()
+
+	management := service.NewManagementService(state)
+	caller := service.Caller{Identity: "app-management"}
+
+	assert.NilError(t, management.CreateRoute(&service.Route{
+		Path:   "/basic",
+		Target: upstream.URL,
+		Auth: &service.RouteAuth{
+			Basic: &service.BasicAuth{Credentials: []service.BasicAuthCredential{{Username: "casaos", Password: "secret"}}},
+		},
+	}, caller, false))
+
+	// one password per username
+	err := management.CreateRoute(&service.Route{
+		Path:   "/duplicate",
+		Target: upstream.URL,
+		Auth: &service.RouteAuth{
+			Basic: &service.BasicAuth{Credentials: []service.BasicAuthCredential{{Username: "casaos", Password: "secret"}, {Username: "casaos", Password: "other"}}},
+		},
+	}, caller, false)
+	assert.Assert(t, errors.Is(err, service.ErrInvalidRouteAuth), err)
+
+	assert.NilError(t, management.CreateRoute(&service.Route{
+		Path:   "/forward",
+		Target: upstream.URL,
+		Auth: &service.RouteAuth{
+			Forward: &service.ForwardAuth{URL: authEndpoint.URL, ResponseHeaders: []string{"X-User"}},
+		},
+	}, caller, false))
+
+	// passwords are only stored as hashes, which are not listed
+	for _, route := range management.GetRoutes() {
+		if route.Auth.Basic != nil {
+			assert.Equal(t, "casaos", route.Auth.Basic.Credentials[0].Username)
+			assert.Equal(t, "", route.Auth.Basic.Credentials[0].Password)
+			assert.Equal(t, "", route.Auth.Basic.Credentials[0].Hash)
+		}
+	}
+
+	router := NewGatewayRoute(management, service.NewAccessLogger(state), service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	serve := func(path string, setup func(r *http.Request)) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		setup(r)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	// basic auth
+	w := serve("/basic", func(r *http.Request) {})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Basic realm="CasaOS", charset="UTF-8"`, w.Header().Get("WWW-Authenticate"))
+
+	w = serve("/basic", func(r *http.Request) { r.SetBasicAuth("casaos", "wrong") })
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	for i := 0; i < 2; i++ { // the second time from cache
+		w = serve("/basic", func(r *http.Request) { r.SetBasicAuth("casaos", "secret") })
+		assert.Equal(t, http.StatusTeapot, w.Code)
+		assert.Equal(t, "", w.Header().Get("X-Upstream-Authorization"))
+	}
+
+	// forward auth
+	w = serve("/forward/app?a=b", func(r *http.Request) {})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "http://casaos.local/#/login?redirect=/forward/app?a=b", w.Header().Get("Location"))
+
+	w = serve("/forward", func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer token")
+		r.Header.Set("X-User", "spoofed")
+	})
+	assert.Equal(t, http.StatusTeapot, w.Code)
+	assert.Equal(t, "admin", w.Header().Get("X-Upstream-User"))
+}
+
+func TestMetrics(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	// a target nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	deadTarget := "http://" + listener.Addr().String()
+	listener.Close()
+
+	management := service.NewManagementService(state)
+	caller := service.Caller{Identity: "app-management"}
+
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, caller, false))
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/dead", Target: deadTarget}, caller, false))
+
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	for _, path := range []string{"/app/a", "/app/b", "/dead/c", "/unknown"} {
+		gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	getMetrics := func() string {
+		w := httptest.NewRecorder()
+		NewManagementRoute(management, nil, service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		body, err := io.ReadAll(w.Body)
+		assert.NilError(t, err)
+
+		return string(body)
+	}
+
+	metrics := getMetrics()
+
+	// labelled by route, not path
+	for _, expected := range []string{
+		`casaos_gateway_requests_total{method="GET",route="/app",status="418"} 2`,
+		`casaos_gateway_requests_total{method="GET",route="/dead",status="502"} 1`,
+		`casaos_gateway_requests_total{method="GET",route="none",status="404"} 1`,
+		`casaos_gateway_upstream_errors_total{route="/dead"} 1`,
+		`casaos_gateway_request_duration_seconds_count{method="GET",route="/app"} 2`,
+		`casaos_gateway_requests_in_flight 0`,
+		`casaos_gateway_routes 2`,
+	} {
+		assert.Assert(t, strings.Contains(metrics, expected), expected)
+	}
+
+	assert.Assert(t, !strings.Contains(metrics, "/app/a"))
+
+	// no series left of a deleted route
+	assert.NilError(t, management.DeleteRoute("/dead", caller, false))
+
+	metrics = getMetrics()
+	assert.Assert(t, !strings.Contains(metrics, `route="/dead"`))
+	assert.Assert(t, strings.Contains(metrics, `casaos_gateway_requests_total{method="GET",route="/app",status="418"} 2`))
+	assert.Assert(t, strings.Contains(metrics, `casaos_gateway_routes 1`))
+}
+
+func TestAccessLog(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	serve := func(format string) []string {
+		state := service.NewState()
+		assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+		filename := filepath.Join(tmpdir, format+".log")
+		assert.NilError(t, state.SetAccessLogOptions(service.AccessLogOptions{
+			Enabled:    true,
+			Format:     format,
+			Filename:   filename,
+			MaxSize:    1,
+			SampleRate: 1,
+		}))
+
+		management := service.NewManagementService(state)
+		caller := service.Caller{Identity: "app-management"}
+
+		assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, caller, false))
+		assert.NilError(t, management.CreateRoute(&service.Route{
+			Path:      "/quiet",
+			Target:    upstream.URL,
+			AccessLog: &service.RouteAccessLog{Disabled: true},
+		}, caller, false))
+
+		accessLogger := service.NewAccessLogger(state)
+		defer accessLogger.Close()
+
+		gateway := NewGatewayRoute(management, accessLogger, service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+		for _, path := range []string{"/app/index.html?a=b", "/quiet/index.html"} {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.RemoteAddr = "192.168.1.2:12345"
+			r.Header.Set("User-Agent", "test")
+			r.Header.Set("X-Forwarded-For", "10.0.0.1") // not from a reverse proxy, so not trusted
+
+			gateway.ServeHTTP(httptest.NewRecorder(), r)
+		}
+
+		buf, err := os.ReadFile(filename)
+		assert.NilError(t, err)
+
+		return strings.Split(strings.TrimSpace(string(buf)), "\n")
+	}
+
+	lines := serve(service.AccessLogFormatCombined)
+	assert.Equal(t, 1, len(lines))
+	assert.Assert(t, strings.HasPrefix(lines[0], "192.168.1.2 - - ["), lines[0])
+	assert.Assert(t, strings.Contains(lines[0], `"GET /app/index.html?a=b HTTP/1.1" 200 5 "-" "test" "/app" "`+upstream.URL+`" `), lines[0])
+
+	lines = serve(service.AccessLogFormatCommon)
+	assert.Equal(t, 1, len(lines))
+	assert.Assert(t, strings.Contains(lines[0], `"GET /app/index.html?a=b HTTP/1.1" 200 5 "/app" "`+upstream.URL+`" `), lines[0])
+
+	lines = serve(service.AccessLogFormatJSON)
+	assert.Equal(t, 1, len(lines))
+
+	var entry map[string]interface{}
+	assert.NilError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "192.168.1.2", entry["client_ip"])
+	assert.Equal(t, "/app", entry["route"])
+	assert.Equal(t, upstream.URL, entry["target"])
+	assert.Equal(t, float64(200), entry["status"])
+	assert.Equal(t, float64(5), entry["bytes"])
+	assert.Assert(t, entry["latency"] != nil)
+	assert.Assert(t, entry["ts"] != nil)
+}
+
+func TestRequestID(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+	assert.NilError(t, state.SetRequestIDOptions(service.RequestIDOptions{Header: "X-Correlation-ID", Format: service.RequestIDFormatHex}))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Correlation-ID", r.Header.Get("X-Correlation-ID"))
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	serve := func(path, requestID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if requestID != "" {
+			r.Header.Set("X-Correlation-ID", requestID)
+		}
+
+		w := httptest.NewRecorder()
+		gateway.ServeHTTP(w, r)
+		return w
+	}
+
+	// kept from the client
+	w := serve("/app", "abc-123")
+	assert.Equal(t, "abc-123", w.Header().Get("X-Correlation-ID"))
+	assert.Equal(t, "abc-123", w.Header().Get("X-Upstream-Correlation-ID"))
+
+	// or generated, also when the one from the client cannot be used as is
+	for _, requestID := range []string{"", "abc 123\r\n", strings.Repeat("a", 129)} {
+		w = serve("/app", requestID)
+		assert.Equal(t, 32, len(w.Header().Get("X-Correlation-ID")))
+		assert.Equal(t, w.Header().Get("X-Correlation-ID"), w.Header().Get("X-Upstream-Correlation-ID"))
+	}
+
+	// in errors from the gateway itself
+	w = serve("/unknown", "abc-456")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	var result service.ErrorResult
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, "abc-456", result.RequestID)
+}
+
+func TestTracing(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	recorder := tracetest.NewSpanRecorder()
+	tracing := service.NewTracingWithProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Traceparent", r.Header.Get("traceparent"))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	// continuing the trace of the client
+	clientTraceID := "4bf92f3577b34da6a3ce929d0e073636"
+	r := httptest.NewRequest(http.MethodGet, "/app/index.html", nil)
+	r.Header.Set("traceparent", "00-"+clientTraceID+"-00f067aa0ba902b7-01")
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusTeapot, w.Code)
+
+	spans := recorder.Ended()
+	assert.Equal(t, 1, len(spans))
+
+	span := spans[0]
+	assert.Equal(t, "GET /app", span.Name())
+	assert.Equal(t, trace.SpanKindServer, span.SpanKind())
+	assert.Equal(t, clientTraceID, span.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", span.Parent().SpanID().String())
+
+	attributes := attribute.NewSet(span.Attributes()...)
+	for key, expected := range map[attribute.Key]string{
+		"http.route":            "/app",
+		"casaos.gateway.target": upstream.URL,
+		"http.target":           "/app/index.html",
+		"http.method":           http.MethodGet,
+	} {
+		value, ok := attributes.Value(key)
+		assert.Assert(t, ok, key)
+		assert.Equal(t, expected, value.AsString())
+	}
+
+	status, ok := attributes.Value("http.status_code")
+	assert.Assert(t, ok)
+	assert.Equal(t, int64(http.StatusTeapot), status.AsInt64())
+
+	// the target gets the span of the gateway as its parent
+	assert.Equal(t, "00-"+clientTraceID+"-"+span.SpanContext().SpanID().String()+"-01", w.Header().Get("X-Upstream-Traceparent"))
+
+	// a new trace without one from the client, with an error for errors from the gateway
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	spans = recorder.Ended()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "HTTP GET", spans[1].Name())
+	assert.Assert(t, !spans[1].Parent().IsValid())
+	assert.Equal(t, codes.Unset, spans[1].Status().Code) // 404 is not an error of the server
+}
+
+func TestAccessLogRedactsToken(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	filename := filepath.Join(tmpdir, "access.log")
+	assert.NilError(t, state.SetAccessLogOptions(service.AccessLogOptions{
+		Enabled:    true,
+		Format:     service.AccessLogFormatCombined,
+		Filename:   filename,
+		MaxSize:    1,
+		SampleRate: 1,
+	}))
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	accessLogger := service.NewAccessLogger(state)
+	defer accessLogger.Close()
+
+	gateway := NewGatewayRoute(management, accessLogger, service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel)).GetRoute()
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/ws?token=secret-token&x=1", nil))
+
+	buf, err := os.ReadFile(filename)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(buf), `"GET /app/ws?token=[redacted]&x=1 HTTP/1.1"`), string(buf))
+	assert.Assert(t, !strings.Contains(string(buf), "secret-token"), string(buf))
+
+	history, _, cancel := management.Inspector.Subscribe(service.InspectorFilter{})
+	defer cancel()
+
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, "/app/ws?token=[redacted]&x=1", history[0].URI)
+}
+
+func TestInspector(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	tracing := service.NewTracingWithProvider(noop.NewTracerProvider())
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	managementServer := httptest.NewServer(NewManagementRoute(management, nil, tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute())
+	defer managementServer.Close()
+
+	// local callers are not admins unless they are made so
+	response, err := http.Get(managementServer.URL + "/v1/gateway/inspect")
+	assert.NilError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode)
+
+	assert.NilError(t, state.SetManagementOptions(service.ManagementOptions{LoopbackBypass: true, Admins: []string{service.OwnerLocal}}))
+
+	response, err = http.Get(managementServer.URL + "/v1/gateway/inspect?status=abc")
+	assert.NilError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+
+	// history from before connecting
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/a", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	response, err = http.Get(managementServer.URL + "/v1/gateway/inspect?route=/app&status=4xx")
+	assert.NilError(t, err)
+	defer response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "text/event-stream", response.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(response.Body)
+	next := func() service.InspectorEntry {
+		var entry service.InspectorEntry
+		for {
+			line, err := events.ReadString('\n')
+			assert.NilError(t, err)
+
+			if data, ok := strings.CutPrefix(line, "data: "); ok {
+				assert.NilError(t, json.Unmarshal([]byte(data), &entry))
+				return entry
+			}
+		}
+	}
+
+	entry := next()
+	assert.Equal(t, "/app/a", entry.URI)
+	assert.Equal(t, http.StatusTeapot, entry.Status)
+	assert.Equal(t, upstream.URL, entry.Target)
+
+	// and live
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/b", nil))
+
+	entry = next()
+	assert.Equal(t, "/app/b", entry.URI)
+	assert.Equal(t, uint64(4), entry.ID)
+}
+
+func TestRouteStats(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/app/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	tracing := service.NewTracingWithProvider(noop.NewTracerProvider())
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+	router := NewManagementRoute(management, nil, tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/app/upload", strings.NewReader("0123456789")))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/missing", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/unknown", nil))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/gateway/routes/"+url.PathEscape("/app")+"/stats", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var stats service.RouteStats
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, uint64(2), stats.Requests)
+	assert.Equal(t, uint64(1), stats.Status2xx)
+	assert.Equal(t, uint64(1), stats.Status4xx)
+	assert.Equal(t, uint64(10), stats.BytesIn)
+	assert.Equal(t, uint64(10), stats.BytesOut)
+	assert.Assert(t, stats.Latency.P99 > 0)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/gateway/routes/"+url.PathEscape("/unknown")+"/stats", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// only on request in the list of routes
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/gateway/routes", nil))
+	assert.Assert(t, !strings.Contains(w.Body.String(), `"stats"`))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/gateway/routes?stats=true", nil))
+
+	var routes []service.RouteWithStats
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&routes))
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "/app", routes[0].Path)
+	assert.Equal(t, uint64(2), routes[0].Stats.Requests)
+}
+
+func TestSlowRequests(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+	assert.NilError(t, state.SetSlowRequestThreshold(time.Hour))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/app/fast":
+		case "/app/download":
+			// quick to respond, slow to finish
+			_, _ = w.Write([]byte("hello"))
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		case "/app/events":
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			time.Sleep(100 * time.Millisecond)
+		default:
+			time.Sleep(100 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	caller := service.Caller{Identity: "app-management"}
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL, SlowRequest: &service.RouteSlowRequest{Threshold: 0.05}}, caller, false))
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/other", Target: upstream.URL}, caller, false))
+
+	tracing := service.NewTracingWithProvider(noop.NewTracerProvider())
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+	router := NewManagementRoute(management, nil, tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/slow?token=secret", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/fast", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/download", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app/events", nil))
+	gateway.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/other/slow", nil)) // under the global threshold
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/gateway/slow", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var result struct {
+		Data struct {
+			Threshold float64                     `json:"threshold"`
+			Routes    []service.RouteSlowRequests `json:"routes"`
+		} `json:"data"`
+	}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, time.Hour.Seconds(), result.Data.Threshold)
+	assert.Equal(t, 1, len(result.Data.Routes))
+
+	slow := result.Data.Routes[0]
+	assert.Equal(t, "/app", slow.Path)
+	assert.Equal(t, 0.05, slow.Threshold)
+	assert.Equal(t, uint64(1), slow.Count)
+	assert.Equal(t, "/app/slow?token=[redacted]", slow.Recent[0].URI)
+	assert.Equal(t, http.StatusOK, slow.Recent[0].Status)
+
+	timing := slow.Recent[0].Timing
+	assert.Assert(t, timing.Total >= 0.1, timing)
+	assert.Assert(t, timing.TimeToFirstByte >= 0.1, timing)
+	assert.Assert(t, timing.Dial > 0 || timing.Reused, timing)
+	assert.Assert(t, timing.Total >= timing.Dial+timing.TimeToFirstByte+timing.Transfer, timing)
+}
+
+func TestIsStreaming(t *testing.T) {
+	header := http.Header{}
+	assert.Assert(t, !isStreaming(http.StatusOK, header))
+	assert.Assert(t, isStreaming(http.StatusSwitchingProtocols, header))
+
+	header.Set("Content-Type", "text/event-stream")
+	assert.Assert(t, isStreaming(http.StatusOK, header))
+
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	assert.Assert(t, !isStreaming(http.StatusOK, header))
+}
+
+func TestRedactURI(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"/app":                                "/app",
+		"/app?x=1":                            "/app?x=1",
+		"/app?token=abc":                      "/app?token=[redacted]",
+		"/app?x=1&Token=abc&access_token=def": "/app?x=1&Token=[redacted]&access_token=[redacted]",
+		"/app?to%6Ben=abc&token":              "/app?to%6Ben=[redacted]&token=[redacted]",
+		"/app?tokens=abc":                     "/app?tokens=abc",
+	} {
+		assert.Equal(t, expected, redactURI(uri))
+	}
+}
+
+func TestRouteDebugLogging(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret-session"})
+	}))
+	defer upstream.Close()
+
+	management := service.NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&service.Route{Path: "/app", Target: upstream.URL}, service.Caller{Identity: "app-management"}, false))
+
+	var output strings.Builder
+	logging := service.NewLogging(zapcore.InfoLevel, zapcore.AddSync(&output))
+
+	tracing := service.NewTracingWithProvider(noop.NewTracerProvider())
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, logging).GetRoute()
+	router := NewManagementRoute(management, nil, tracing, logging).GetRoute()
+
+	serve := func(handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Authorization", "Bearer secret-token")
+		r.RemoteAddr = "127.0.0.1:12345"
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// admins only
+	w := serve(router, http.MethodPut, "/v1/gateway/logging", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	assert.NilError(t, state.SetManagementOptions(service.ManagementOptions{LoopbackBypass: true, Admins: []string{service.OwnerLocal}}))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, strings.Contains(w.Body.String(), "goroutine"))
+
+	r = httptest.NewRequest(http.MethodPut, "/v1/gateway/logging", strings.NewReader(`{"level":"verbose"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// nothing in detail at info
+	serve(gateway, http.MethodGet, "/app/a", "")
+	assert.Equal(t, "", output.String())
+
+	r = httptest.NewRequest(http.MethodPut, "/v1/gateway/logging/routes/"+url.PathEscape("/app"), strings.NewReader(`{"duration":"10m"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	serve(gateway, http.MethodGet, "/app/b?token=secret-query&x=1", "")
+
+	line := output.String()
+	assert.Assert(t, strings.Contains(line, `"uri": "/app/b?token=[redacted]&x=1"`), line)
+	assert.Assert(t, !strings.Contains(line, "secret-query"), line)
+	assert.Assert(t, strings.Contains(line, "[redacted]"), line)
+	assert.Assert(t, !strings.Contains(line, "secret-token"), line)
+	assert.Assert(t, !strings.Contains(line, "secret-session"), line)
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/gateway/logging", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Assert(t, strings.Contains(w.Body.String(), `"path":"/app"`), w.Body.String())
+
+	r = httptest.NewRequest(http.MethodDelete, "/v1/gateway/logging/routes/"+url.PathEscape("/app"), nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Assert(t, !logging.RouteDebugEnabled("/app"))
+}
+
+func TestStaticSecurityHeaders(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	assert.NilError(t, os.WriteFile(filepath.Join(tmpdir, "index.html"), []byte("<html></html>"), 0o600))
+
+	state := service.NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+	assert.NilError(t, state.SetWWWPath(tmpdir))
+	assert.NilError(t, state.SetSecurityHeaders(service.SecurityHeaders{
+		ContentTypeOptions: "nosniff",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		FrameAncestors:     "'self'",
+	}))
+
+	management := service.NewManagementService(state)
+	tracing := service.NewTracingWithProvider(noop.NewTracerProvider())
+
+	static := httptest.NewServer(NewStaticRoute(state, management.Metrics, tracing).GetRoute())
+	defer static.Close()
+
+	// the override of the route in front of the static web is what the client gets
+	assert.NilError(t, management.CreateRoute(&service.Route{
+		Path:   "/",
+		Target: static.URL,
+		Headers: &service.SecurityHeaders{
+			ContentTypeOptions: service.HeaderOff,
+			FrameAncestors:     "'self' http://casaos.local",
+		},
+	}, service.GatewayCaller, false))
+
+	gateway := NewGatewayRoute(management, service.NewAccessLogger(state), tracing, service.NewLogging(zapcore.InfoLevel)).GetRoute()
+
+	w := httptest.NewRecorder()
+	gateway.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("X-Content-Type-Options"))
+	assert.Equal(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"))
+	assert.Equal(t, "frame-ancestors 'self' http://casaos.local", w.Header().Get("Content-Security-Policy"))
+}
@@ -0,0 +1,67 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"github.com/labstack/echo/v4"
+)
+
+// a comment line every so often, so that proxies in between do not close an idle stream
+const inspectorKeepAliveInterval = 15 * time.Second
+
+// Stream the requests through the gateway that match `filter` as server-sent events, starting with the recent ones.
+func (m *ManagementRoute) streamInspector(ctx echo.Context, filter service.InspectorFilter) error {
+	history, entries, cancel := m.management.Inspector.Subscribe(filter)
+	defer cancel()
+
+	response := ctx.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+
+	for _, entry := range history {
+		if err := writeInspectorEvent(response, entry); err != nil {
+			return nil
+		}
+	}
+	response.Flush()
+
+	keepAlive := time.NewTicker(inspectorKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-ctx.Request().Context().Done():
+			return nil
+
+		case entry := <-entries:
+			if err := writeInspectorEvent(response, entry); err != nil {
+				return nil
+			}
+			response.Flush()
+
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			response.Flush()
+		}
+	}
+}
+
+// the ID of the entry lets a client tell which ones it has missed
+func writeInspectorEvent(w http.ResponseWriter, entry service.InspectorEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %s\nevent: request\ndata: %s\n\n", strconv.FormatUint(entry.ID, 10), data)
+	return err
+}
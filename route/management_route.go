@@ -1,40 +1,59 @@
 package route
 
 import (
+	"context"
 	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"net/url"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/IceWhaleTech/CasaOS-Common/external"
 	"github.com/IceWhaleTech/CasaOS-Common/model"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/common_err"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/jwt"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/IceWhaleTech/CasaOS-Gateway/service"
 	"github.com/labstack/echo/v4"
 	echo_middleware "github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
+	"go.uber.org/zap"
 )
 
 type ManagementRoute struct {
-	management *service.Management
+	management  *service.Management
+	acmeManager *service.ACMEManager
+	tracing     *service.Tracing
+	logging     *service.Logging
 }
 
-func NewManagementRoute(management *service.Management) *ManagementRoute {
+func NewManagementRoute(management *service.Management, acmeManager *service.ACMEManager, tracing *service.Tracing, logging *service.Logging) *ManagementRoute {
 	return &ManagementRoute{
-		management: management,
+		management:  management,
+		acmeManager: acmeManager,
+		tracing:     tracing,
+		logging:     logging,
 	}
 }
 
 func (m *ManagementRoute) GetRoute() http.Handler {
 	e := echo.New()
 
-	e.Use((echo_middleware.CORSWithConfig(echo_middleware.CORSConfig{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{echo.POST, echo.GET, echo.OPTIONS, echo.PUT, echo.DELETE},
-		AllowHeaders:     []string{echo.HeaderAuthorization, echo.HeaderContentLength, echo.HeaderXCSRFToken, echo.HeaderContentType, echo.HeaderAccessControlAllowOrigin, echo.HeaderAccessControlAllowHeaders, echo.HeaderAccessControlAllowMethods, echo.HeaderConnection, echo.HeaderOrigin, echo.HeaderXRequestedWith},
-		ExposeHeaders:    []string{echo.HeaderContentLength, echo.HeaderAccessControlAllowOrigin, echo.HeaderAccessControlAllowHeaders},
-		MaxAge:           172800,
-		AllowCredentials: true,
-	})))
+	e.Use(otelecho.Middleware(service.TracingServiceName+"-management",
+		otelecho.WithTracerProvider(m.tracing.TracerProvider()),
+		otelecho.WithPropagators(m.tracing.Propagator()),
+	))
+
+	e.Use(m.cors())
 
 	e.Use(echo_middleware.Gzip())
 
@@ -44,6 +63,39 @@ func (m *ManagementRoute) GetRoute() http.Handler {
 		})
 	})
 
+	// only on the management server - the gateway has no route to it
+	e.GET("/metrics", echo.WrapHandler(m.management.Metrics.Handler()))
+
+	// liveness - the process can still serve requests
+	e.GET("/healthz", func(ctx echo.Context) error {
+		return ctx.JSON(http.StatusOK, echo.Map{
+			"status": service.HealthStatusOK,
+		})
+	})
+
+	// readiness - degraded is still ready, as only some apps are affected
+	e.GET("/readyz", func(ctx echo.Context) error {
+		readiness := m.management.Health.Readiness(ctx.Request().Context())
+
+		status := http.StatusOK
+		if readiness.Status == service.HealthStatusUnavailable {
+			status = http.StatusServiceUnavailable
+		}
+
+		return ctx.JSON(status, readiness)
+	})
+
+	// profiles of the gateway itself, also only on the management server
+	pprofGroup := e.Group("/debug/pprof", m.jwt(), m.admin())
+	{
+		pprofGroup.GET("/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+		pprofGroup.GET("/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+		pprofGroup.GET("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		pprofGroup.POST("/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		pprofGroup.GET("/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+		pprofGroup.GET("/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	}
+
 	m.buildV1Group(e)
 
 	return e
@@ -64,12 +116,36 @@ func (m *ManagementRoute) buildV1RouteGroup(v1Group *echo.Group) {
 	v1GatewayGroup.Use()
 	{
 		v1GatewayGroup.GET("/routes", func(ctx echo.Context) error {
+			if stats, _ := strconv.ParseBool(ctx.QueryParam("stats")); stats {
+				return ctx.JSON(http.StatusOK, m.management.GetRoutesWithStats())
+			}
+
 			return ctx.JSON(http.StatusOK, m.management.GetRoutes())
 		})
 
+		v1GatewayGroup.GET("/routes/:path/stats", func(ctx echo.Context) error {
+			path, err := url.PathUnescape(ctx.Param("path"))
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			stats, err := m.management.GetRouteStats(path)
+			if err != nil {
+				return ctx.JSON(routeErrorStatus(err), model.Result{
+					Success: routeErrorCode(err),
+					Message: err.Error(),
+				})
+			}
+
+			return ctx.JSON(http.StatusOK, stats)
+		})
+
 		v1GatewayGroup.POST("/routes",
 			func(ctx echo.Context) error {
-				var route *model.Route
+				var route *service.Route
 				err := ctx.Bind(&route)
 				if err != nil {
 					return ctx.JSON(http.StatusBadRequest, model.Result{
@@ -78,38 +154,227 @@ func (m *ManagementRoute) buildV1RouteGroup(v1Group *echo.Group) {
 					})
 				}
 
-				if err := m.management.CreateRoute(route); err != nil {
-					return ctx.JSON(http.StatusInternalServerError, model.Result{
-						Success: common_err.SERVICE_ERROR,
+				if err := m.management.CreateRoute(route, m.callerFrom(ctx), forceFrom(ctx)); err != nil {
+					return ctx.JSON(routeErrorStatus(err), model.Result{
+						Success: routeErrorCode(err),
 						Message: err.Error(),
 					})
 				}
 
 				return ctx.NoContent(http.StatusCreated)
 			},
-			echo_middleware.JWTWithConfig(echo_middleware.JWTConfig{
-				Skipper: func(c echo.Context) bool {
-					return c.RealIP() == "::1" || c.RealIP() == "127.0.0.1"
-					// return true
-				},
-				ParseTokenFunc: func(token string, c echo.Context) (interface{}, error) {
-					valid, claims, err := jwt.Validate(token, func() (*ecdsa.PublicKey, error) { return external.GetPublicKey(m.management.State.GetRuntimePath()) })
-					if err != nil || !valid {
-						return nil, echo.ErrUnauthorized
-					}
-					c.Request().Header.Set("user_id", strconv.Itoa(claims.ID))
+			m.jwt())
+
+		v1GatewayGroup.DELETE("/routes/:path",
+			func(ctx echo.Context) error {
+				path, err := url.PathUnescape(ctx.Param("path"))
+				if err != nil {
+					return ctx.JSON(http.StatusBadRequest, model.Result{
+						Success: common_err.CLIENT_ERROR,
+						Message: err.Error(),
+					})
+				}
+
+				if err := m.management.DeleteRoute(path, m.callerFrom(ctx), forceFrom(ctx)); err != nil {
+					return ctx.JSON(routeErrorStatus(err), model.Result{
+						Success: routeErrorCode(err),
+						Message: err.Error(),
+					})
+				}
+
+				return ctx.NoContent(http.StatusNoContent)
+			},
+			m.jwt())
+
+		v1GatewayGroup.GET("/tls/ca", func(ctx echo.Context) error {
+			options := m.management.State.GetTLSOptions()
+			if !options.Enabled || options.SelfSignedPath == "" {
+				return ctx.JSON(http.StatusNotFound, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: "self-signed certificate is not enabled",
+				})
+			}
+
+			ctx.Response().Header().Set(echo.HeaderContentType, "application/x-x509-ca-cert")
+			return ctx.Attachment(filepath.Join(options.SelfSignedPath, service.CACertFilename), "casaos-ca.crt")
+		})
+
+		v1GatewayGroup.GET("/tls/acme", func(ctx echo.Context) error {
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data:    m.acmeManager.Status(),
+			})
+		}, m.jwt())
 
-					return claims, nil
+		v1GatewayGroup.POST("/tls/acme/renew", func(ctx echo.Context) error {
+			status := m.acmeManager.Status()
+			if !status.Enabled {
+				return ctx.JSON(http.StatusNotFound, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: service.ErrACMENotEnabled.Error(),
+				})
+			}
+
+			if status.InProgress {
+				return ctx.JSON(http.StatusConflict, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: service.ErrACMEInProgress.Error(),
+				})
+			}
+
+			// it can take minutes for the ACME server to validate challenges, so check the status for the result.
+			go func() {
+				if err := m.acmeManager.Renew(context.Background()); err != nil {
+					logger.Error("Failed to renew ACME certificate", zap.Any("error", err))
+				}
+			}()
+
+			return ctx.JSON(http.StatusAccepted, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+			})
+		}, m.jwt())
+
+		v1GatewayGroup.GET("/audit", func(ctx echo.Context) error {
+			filter, err := auditFilterFrom(ctx)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			entries, err := m.management.GetAuditEntries(filter)
+			if err != nil {
+				return ctx.JSON(http.StatusInternalServerError, model.Result{
+					Success: common_err.SERVICE_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data:    entries,
+			})
+		}, m.jwt())
+
+		v1GatewayGroup.GET("/inspect", func(ctx echo.Context) error {
+			filter, err := inspectorFilterFrom(ctx)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			return m.streamInspector(ctx, filter)
+		}, m.jwt(), m.admin())
+
+		v1GatewayGroup.GET("/slow", func(ctx echo.Context) error {
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data: echo.Map{
+					"threshold": m.management.State.GetSlowRequestThreshold().Seconds(),
+					"routes":    m.management.GetSlowRequests(),
 				},
-				TokenLookupFuncs: []echo_middleware.ValuesExtractor{
-					func(c echo.Context) ([]string, error) {
-						if len(c.Request().Header.Get(echo.HeaderAuthorization)) > 0 {
-							return []string{c.Request().Header.Get(echo.HeaderAuthorization)}, nil
-						}
-						return []string{c.QueryParam("token")}, nil
-					},
+			})
+		}, m.jwt())
+
+		v1GatewayGroup.GET("/logging", func(ctx echo.Context) error {
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data: echo.Map{
+					"level":  m.logging.Level().String(),
+					"routes": m.logging.GetRouteDebugs(),
 				},
-			}))
+			})
+		}, m.jwt(), m.admin())
+
+		v1GatewayGroup.PUT("/logging", func(ctx echo.Context) error {
+			var request struct {
+				Level string `json:"level"`
+			}
+			if err := ctx.Bind(&request); err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			if err := m.logging.SetLevel(request.Level); err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data:    m.logging.Level().String(),
+			})
+		}, m.jwt(), m.admin())
+
+		// the route does not have to be registered yet, e.g. for an app that is starting
+		v1GatewayGroup.PUT("/logging/routes/:path", func(ctx echo.Context) error {
+			path, err := url.PathUnescape(ctx.Param("path"))
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			request := struct {
+				Duration string `json:"duration"`
+			}{Duration: "15m"}
+			if err := ctx.Bind(&request); err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			duration, err := time.ParseDuration(request.Duration)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: "invalid `duration` - expected e.g. 15m",
+				})
+			}
+
+			debug, err := m.logging.SetRouteDebug(path, duration)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			return ctx.JSON(http.StatusOK, model.Result{
+				Success: common_err.SUCCESS,
+				Message: common_err.GetMsg(common_err.SUCCESS),
+				Data:    debug,
+			})
+		}, m.jwt(), m.admin())
+
+		v1GatewayGroup.DELETE("/logging/routes/:path", func(ctx echo.Context) error {
+			path, err := url.PathUnescape(ctx.Param("path"))
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, model.Result{
+					Success: common_err.CLIENT_ERROR,
+					Message: err.Error(),
+				})
+			}
+
+			m.logging.ClearRouteDebug(path)
+
+			return ctx.NoContent(http.StatusNoContent)
+		}, m.jwt(), m.admin())
 
 		v1GatewayGroup.GET("/port", func(ctx echo.Context) error {
 			return ctx.JSON(http.StatusOK, model.Result{
@@ -130,11 +395,28 @@ func (m *ManagementRoute) buildV1RouteGroup(v1Group *echo.Group) {
 					})
 				}
 
-				if err := m.management.SetGatewayPort(request.Port); err != nil {
-					return ctx.JSON(http.StatusInternalServerError, model.Result{
+				if err := m.management.SetGatewayPort(request.Port, m.callerFrom(ctx)); err != nil {
+					result := model.Result{
 						Success: common_err.SERVICE_ERROR,
 						Message: err.Error(),
-					})
+					}
+
+					// which step failed, and what was rolled back
+					var portChangeErr *service.PortChangeError
+					if errors.As(err, &portChangeErr) {
+						result.Data = portChangeErr
+					}
+
+					if errors.Is(err, service.ErrGatewayPortActivated) {
+						result.Success = common_err.CLIENT_ERROR
+						return ctx.JSON(http.StatusConflict, result)
+					}
+
+					if errors.Is(err, service.ErrWritesSuspended) {
+						return ctx.JSON(http.StatusServiceUnavailable, result)
+					}
+
+					return ctx.JSON(http.StatusInternalServerError, result)
 				}
 
 				return ctx.JSON(http.StatusOK, model.Result{
@@ -142,28 +424,236 @@ func (m *ManagementRoute) buildV1RouteGroup(v1Group *echo.Group) {
 					Message: common_err.GetMsg(common_err.SUCCESS),
 				})
 			},
-			echo_middleware.JWTWithConfig(echo_middleware.JWTConfig{
-				Skipper: func(c echo.Context) bool {
-					return c.RealIP() == "::1" || c.RealIP() == "127.0.0.1"
-					// return true
-				},
-				ParseTokenFunc: func(token string, c echo.Context) (interface{}, error) {
-					valid, claims, err := jwt.Validate(token, func() (*ecdsa.PublicKey, error) { return external.GetPublicKey(m.management.State.GetRuntimePath()) })
-					if err != nil || !valid {
-						return nil, echo.ErrUnauthorized
-					}
-					c.Request().Header.Set("user_id", strconv.Itoa(claims.ID))
+			m.jwt())
+	}
+}
 
-					return claims, nil
-				},
-				TokenLookupFuncs: []echo_middleware.ValuesExtractor{
-					func(c echo.Context) ([]string, error) {
-						if len(c.Request().Header.Get(echo.HeaderAuthorization)) > 0 {
-							return []string{c.Request().Header.Get(echo.HeaderAuthorization)}, nil
-						}
-						return []string{c.QueryParam("token")}, nil
-					},
-				},
-			}))
+// The CORS policy can be changed in gateway.ini while running, so the middleware is rebuilt whenever it changes.
+func (m *ManagementRoute) cors() echo.MiddlewareFunc {
+	var (
+		options service.CORSOptions
+		allow   echo.MiddlewareFunc
+		deny    echo.MiddlewareFunc
+		mutex   sync.Mutex
+	)
+
+	// the origin is checked here rather than by the middleware, as the default depends on the host of the request
+	corsWith := func(options service.CORSOptions, allowed bool) echo.MiddlewareFunc {
+		return echo_middleware.CORSWithConfig(echo_middleware.CORSConfig{
+			AllowOriginFunc: func(string) (bool, error) {
+				return allowed, nil
+			},
+			AllowMethods:     options.AllowMethods,
+			AllowHeaders:     options.AllowHeaders,
+			ExposeHeaders:    []string{echo.HeaderContentLength, echo.HeaderAccessControlAllowOrigin, echo.HeaderAccessControlAllowHeaders},
+			MaxAge:           options.MaxAge,
+			AllowCredentials: options.AllowCredentials,
+		})
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			current := m.management.State.GetCORSOptions()
+
+			mutex.Lock()
+			if allow == nil || !reflect.DeepEqual(options, current) {
+				options = current
+				allow = corsWith(current, true)
+				deny = corsWith(current, false)
+			}
+			cors := deny
+			if origin := ctx.Request().Header.Get(echo.HeaderOrigin); origin != "" && current.AllowsOrigin(origin, ctx.Request().Host, m.management.State.GetGatewayPorts()) {
+				cors = allow
+			}
+			handler := cors(next)
+			mutex.Unlock()
+
+			return handler(ctx)
+		}
+	}
+}
+
+// JWT is required unless the request comes from a trusted peer on the Unix socket, with a verified client certificate,
+// or from loopback when that is allowed.
+func (m *ManagementRoute) jwt() echo.MiddlewareFunc {
+	return echo_middleware.JWTWithConfig(echo_middleware.JWTConfig{
+		Skipper: func(c echo.Context) bool {
+			if _, ok := m.trustedPeerFrom(c); ok {
+				return true
+			}
+
+			if _, ok := clientCertificateFrom(c); ok {
+				return true
+			}
+
+			return m.management.State.GetManagementOptions().LoopbackBypass && (c.RealIP() == "::1" || c.RealIP() == "127.0.0.1")
+		},
+		ParseTokenFunc: func(token string, c echo.Context) (interface{}, error) {
+			valid, claims, err := jwt.Validate(token, func() (*ecdsa.PublicKey, error) { return external.GetPublicKey(m.management.State.GetRuntimePath()) })
+			if err != nil || !valid {
+				return nil, echo.ErrUnauthorized
+			}
+			c.Request().Header.Set("user_id", strconv.Itoa(claims.ID))
+
+			return claims, nil
+		},
+		TokenLookupFuncs: []echo_middleware.ValuesExtractor{
+			func(c echo.Context) ([]string, error) {
+				if len(c.Request().Header.Get(echo.HeaderAuthorization)) > 0 {
+					return []string{c.Request().Header.Get(echo.HeaderAuthorization)}, nil
+				}
+				return []string{c.QueryParam("token")}, nil
+			},
+		},
+	})
+}
+
+// Only admins, after `jwt()`.
+func (m *ManagementRoute) admin() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !m.callerFrom(ctx).Admin {
+				return ctx.JSON(http.StatusForbidden, model.Result{
+					Success: common_err.INSUFFICIENT_PERMISSIONS,
+					Message: "only admins are allowed",
+				})
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// Users signed in to CasaOS are the admins of the box. Trusted peers on the Unix socket are identified by their user,
+// services with a client certificate by its subject, and anyone else got here by being on loopback.
+//
+// Note: the `user_id` header is not used here, because a loopback caller can set it to anything.
+func (m *ManagementRoute) callerFrom(ctx echo.Context) service.Caller {
+	caller := service.Caller{Identity: service.OwnerLocal, ClientIP: ctx.RealIP()}
+
+	options := m.management.State.GetManagementOptions()
+
+	if claims, ok := ctx.Get("user").(*jwt.Claims); ok {
+		caller.Identity = "user:" + strconv.Itoa(claims.ID)
+		caller.Admin = true
+		return caller
+	}
+
+	if peer, ok := m.trustedPeerFrom(ctx); ok {
+		caller.Identity = peer.Identity()
+	} else if certificate, ok := clientCertificateFrom(ctx); ok {
+		caller.Identity = certificateIdentity(certificate)
+	}
+
+	caller.Admin = options.IsAdmin(caller.Identity)
+
+	return caller
+}
+
+// returns the peer of the Unix socket connection, if the request came through it and its uid or gid is allowed.
+func (m *ManagementRoute) trustedPeerFrom(ctx echo.Context) (*PeerCredentials, bool) {
+	peer, ok := peerCredentialsFrom(ctx.Request().Context())
+	if !ok || !m.management.State.GetManagementOptions().AllowsPeer(peer.UID, peer.GID) {
+		return nil, false
+	}
+
+	return peer, true
+}
+
+// returns the client certificate of the request, if it came through the mTLS listener and the certificate is verified.
+func clientCertificateFrom(ctx echo.Context) (*x509.Certificate, bool) {
+	state := ctx.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	return state.VerifiedChains[0][0], true
+}
+
+// the identity of a service with a client certificate is its common name, or its first DNS name without one.
+func certificateIdentity(certificate *x509.Certificate) string {
+	if certificate.Subject.CommonName == "" && len(certificate.DNSNames) > 0 {
+		return "cert:" + certificate.DNSNames[0]
+	}
+
+	return "cert:" + certificate.Subject.CommonName
+}
+
+// `since` and `until` are in RFC 3339, and `operation` is a comma separated list.
+func auditFilterFrom(ctx echo.Context) (service.AuditFilter, error) {
+	var filter service.AuditFilter
+
+	for name, value := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if param := ctx.QueryParam(name); param != "" {
+			t, err := time.Parse(time.RFC3339, param)
+			if err != nil {
+				return filter, fmt.Errorf("invalid `%s` - expected RFC 3339, e.g. 2006-01-02T15:04:05Z", name)
+			}
+			*value = t
+		}
+	}
+
+	if operations := ctx.QueryParam("operation"); operations != "" {
+		filter.Operations = strings.Split(operations, ",")
+	}
+
+	return filter, nil
+}
+
+// `route` is the path of a route as registered, `status` a comma separated list of codes or classes like `5xx`, and
+// `client_ip` an IP or a network.
+func inspectorFilterFrom(ctx echo.Context) (service.InspectorFilter, error) {
+	filter := service.InspectorFilter{Route: ctx.QueryParam("route")}
+
+	if statuses := ctx.QueryParam("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			if !service.IsValidStatusFilter(status) {
+				return filter, fmt.Errorf("invalid `status` %s - expected a status code, or a class of them like 5xx", status)
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+
+	if clientIP := ctx.QueryParam("client_ip"); clientIP != "" {
+		prefix, err := netip.ParsePrefix(clientIP)
+		if err != nil {
+			addr, err := netip.ParseAddr(clientIP)
+			if err != nil {
+				return filter, fmt.Errorf("invalid `client_ip` %s - expected an IP, or a network like 192.168.1.0/24", clientIP)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		filter.ClientIP = prefix.Masked()
+	}
+
+	return filter, nil
+}
+
+func forceFrom(ctx echo.Context) bool {
+	force, _ := strconv.ParseBool(ctx.QueryParam("force"))
+	return force
+}
+
+func routeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, service.ErrRouteConflict), errors.Is(err, service.ErrRouteReserved):
+		return http.StatusConflict
+	case errors.Is(err, service.ErrRouteNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, service.ErrForceNotAllowed):
+		return http.StatusForbidden
+	case errors.Is(err, service.ErrInvalidRouteAuth), errors.Is(err, service.ErrInvalidRoute):
+		return http.StatusBadRequest
+	case errors.Is(err, service.ErrWritesSuspended):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func routeErrorCode(err error) int {
+	if routeErrorStatus(err) >= http.StatusInternalServerError {
+		return common_err.SERVICE_ERROR
 	}
+	return common_err.CLIENT_ERROR
 }
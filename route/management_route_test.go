@@ -2,24 +2,42 @@ package route
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
 	"github.com/labstack/echo/v4"
 
 	"github.com/IceWhaleTech/CasaOS-Common/model"
 	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap/zapcore"
 	"gotest.tools/v3/assert"
 )
 
 var (
-	_router http.Handler
-	_state  *service.State
+	_router     http.Handler
+	_state      *service.State
+	_management *service.Management
 )
 
 func init() {
@@ -34,12 +52,17 @@ func setup(t *testing.T) func(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	management := service.NewManagementService(_state)
-	managementRoute := NewManagementRoute(management)
+	_management = service.NewManagementService(_state)
+	acmeManager, err := service.NewACMEManager(_state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	managementRoute := NewManagementRoute(_management, acmeManager, service.NewTracingWithProvider(noop.NewTracerProvider()), service.NewLogging(zapcore.InfoLevel))
 	_router = managementRoute.GetRoute()
 
 	return func(t *testing.T) {
-		management = nil
+		_management = nil
 		_router = nil
 		os.RemoveAll(tmpdir)
 	}
@@ -57,6 +80,25 @@ func TestPing(t *testing.T) {
 	assert.Equal(t, http.StatusOK, w.Code)
 }
 
+func TestHealth(t *testing.T) {
+	defer setup(t)(t)
+
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// none of the servers are started in tests
+	w = httptest.NewRecorder()
+	_router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	var readiness service.Readiness
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&readiness))
+	assert.Equal(t, service.HealthStatusUnavailable, readiness.Status)
+	assert.Equal(t, service.HealthStatusFail, readiness.Checks["gateway_server"].Status)
+	assert.Equal(t, service.HealthStatusOK, readiness.Checks["runtime_path"].Status)
+}
+
 func TestCreateRoute(t *testing.T) {
 	defer setup(t)(t)
 
@@ -92,6 +134,46 @@ func TestCreateRoute(t *testing.T) {
 	assert.Equal(t, route.Target, routes[0].Target)
 }
 
+func TestCreateRouteConflict(t *testing.T) {
+	defer setup(t)(t)
+
+	assert.NilError(t, _state.SetReservedPaths([]string{"/v1/gateway"}))
+
+	for path, expected := range map[string]int{
+		"/v1/gateway/routes": http.StatusConflict,
+		"/test":              http.StatusCreated,
+	} {
+		body, err := json.Marshal(&model.Route{
+			Path:   path,
+			Target: "http://localhost:8080",
+		})
+		assert.NilError(t, err)
+
+		req, _ := http.NewRequest(http.MethodPost, "/v1/gateway/routes", bytes.NewReader(body))
+		req.RemoteAddr = "127.0.0.1:0"
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		w := httptest.NewRecorder()
+		_router.ServeHTTP(w, req)
+		assert.Equal(t, expected, w.Code)
+	}
+
+	// only an admin can force
+	req, _ := http.NewRequest(http.MethodDelete, "/v1/gateway/routes/"+url.PathEscape("/test")+"?force=true", nil)
+	req.RemoteAddr = "127.0.0.1:0"
+
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req, _ = http.NewRequest(http.MethodDelete, "/v1/gateway/routes/"+url.PathEscape("/test"), nil)
+	req.RemoteAddr = "127.0.0.1:0"
+
+	w = httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
 func TestChangePort(t *testing.T) {
 	defer setup(t)(t)
 
@@ -138,6 +220,52 @@ func TestChangePort(t *testing.T) {
 	assert.Equal(t, expectedPort, result.Data)
 }
 
+func TestCreateRouteWritesSuspended(t *testing.T) {
+	defer setup(t)(t)
+
+	_state.SuspendWrites()
+
+	body, err := json.Marshal(&model.Route{Path: "/test", Target: "http://localhost:8080"})
+	assert.NilError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPost, "/v1/gateway/routes", bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	_state.ResumeWrites()
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest(http.MethodPost, "/v1/gateway/routes", bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	_router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
+
+func TestChangePortActivated(t *testing.T) {
+	defer setup(t)(t)
+
+	_state.SetActivatedGatewayPort("80")
+
+	body, err := json.Marshal(&model.ChangePortRequest{Port: "8080"})
+	assert.NilError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPut, "/v1/gateway/port", bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Assert(t, bytes.Contains(w.Body.Bytes(), []byte("socket unit")))
+	assert.Equal(t, "80", _state.GetGatewayPort())
+}
+
 func TestChangePortNegative(t *testing.T) {
 	defer setup(t)(t)
 
@@ -212,3 +340,285 @@ func TestChangePortNegative(t *testing.T) {
 	assert.NilError(t, err)
 	assert.Equal(t, expectedPort, result.Data)
 }
+
+func TestChangePortRollback(t *testing.T) {
+	defer setup(t)(t)
+
+	assert.NilError(t, _state.SetGatewayPort("123"))
+
+	rolledBack := ""
+
+	_state.AddPortChangeStep(service.PortChangeStep{
+		Name:    "config",
+		Prepare: func(string) error { return errors.New("read-only file system") },
+	})
+
+	_state.AddPortChangeStep(service.PortChangeStep{
+		Name:     "gateway",
+		Prepare:  func(string) error { return nil },
+		Rollback: func(previous string) error { rolledBack = previous; return nil },
+	})
+
+	body, err := json.Marshal(&model.ChangePortRequest{Port: "456"})
+	assert.NilError(t, err)
+
+	req, _ := http.NewRequest(http.MethodPut, "/v1/gateway/port", bytes.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:0"
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, "123", rolledBack)
+	assert.Equal(t, "123", _state.GetGatewayPort())
+
+	var result struct {
+		Data service.PortChangeError `json:"data"`
+	}
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, "456", result.Data.Port)
+	assert.Equal(t, "config", result.Data.Step)
+	assert.Equal(t, "read-only file system", result.Data.PortChangeStepFailure.Error)
+	assert.DeepEqual(t, []string{"gateway"}, result.Data.RolledBack)
+}
+
+func TestCORS(t *testing.T) {
+	defer setup(t)(t)
+
+	assert.NilError(t, _state.SetGatewayPort("8080"))
+
+	allowedOrigin := func(origin string) string {
+		req, _ := http.NewRequest(http.MethodOptions, "/v1/gateway/port", nil)
+		req.Host = "192.168.1.2:8080"
+		req.Header.Set(echo.HeaderOrigin, origin)
+		req.Header.Set(echo.HeaderAccessControlRequestMethod, http.MethodPut)
+
+		w := httptest.NewRecorder()
+		_router.ServeHTTP(w, req)
+
+		return w.Header().Get(echo.HeaderAccessControlAllowOrigin)
+	}
+
+	// by default, only the CasaOS UI at the gateway port
+	assert.Equal(t, "http://192.168.1.2:8080", allowedOrigin("http://192.168.1.2:8080"))
+	assert.Equal(t, "", allowedOrigin("http://192.168.1.2:8081"))
+	assert.Equal(t, "", allowedOrigin("http://evil.com"))
+
+	// not any host on the gateway port, e.g. another site served on port 80
+	assert.Equal(t, "", allowedOrigin("http://evil.com:8080"))
+	assert.Equal(t, "http://localhost:8080", allowedOrigin("http://localhost:8080"))
+
+	// reloaded without rebuilding the route
+	assert.NilError(t, _state.SetCORSOptions(service.CORSOptions{
+		AllowOrigins:     []string{"https://casaos.example.com"},
+		AllowMethods:     []string{http.MethodGet, http.MethodPut},
+		AllowCredentials: true,
+		MaxAge:           60,
+	}))
+
+	assert.Equal(t, "https://casaos.example.com", allowedOrigin("https://casaos.example.com"))
+	assert.Equal(t, "", allowedOrigin("http://192.168.1.2:8080"))
+
+	// any origin could act with the credentials of the user
+	err := _state.SetCORSOptions(service.CORSOptions{AllowOrigins: []string{"*"}, AllowCredentials: true})
+	assert.Assert(t, errors.Is(err, service.ErrInvalidCORSOptions))
+	assert.Equal(t, "https://casaos.example.com", allowedOrigin("https://casaos.example.com"))
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+
+	defer setup(t)(t)
+
+	socketPath := filepath.Join(_state.GetRuntimePath(), "management.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	assert.NilError(t, err)
+
+	server := &http.Server{
+		Handler:           _router,
+		ReadHeaderTimeout: 5 * time.Second,
+		ConnContext:       WithPeerCredentials,
+	}
+	go server.Serve(listener) // nolint: errcheck
+	defer server.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+
+	createRoute := func(path string) int {
+		body, err := json.Marshal(&model.Route{Path: path, Target: "http://localhost:8080"})
+		assert.NilError(t, err)
+
+		req, _ := http.NewRequest(http.MethodPost, "http://unix/v1/gateway/routes", bytes.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+
+		resp, err := client.Do(req)
+		assert.NilError(t, err)
+		defer resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	uid := uint32(os.Getuid())
+
+	// a peer that is not allowed still needs a JWT
+	assert.NilError(t, _state.SetManagementOptions(service.ManagementOptions{AllowUIDs: []uint32{uid + 1}}))
+	assert.Equal(t, http.StatusUnauthorized, createRoute("/test"))
+
+	// a trusted peer does not, and owns the route as its user
+	assert.NilError(t, _state.SetManagementOptions(service.ManagementOptions{AllowUIDs: []uint32{uid}}))
+	assert.Equal(t, http.StatusCreated, createRoute("/test"))
+
+	req, _ := http.NewRequest(http.MethodGet, "/v1/gateway/routes", nil)
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+
+	var routes []*service.Route
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&routes))
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, (&PeerCredentials{UID: uid}).Identity(), routes[0].Owner)
+
+	// with the loopback bypass off (as in the options above), loopback needs a JWT too
+	req, _ = http.NewRequest(http.MethodDelete, "/v1/gateway/routes/"+url.PathEscape("/test"), nil)
+	req.RemoteAddr = "127.0.0.1:0"
+
+	w = httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+// issue a certificate from `parent`, or a self-signed one if `parent` is nil. Returns the certificate and key in PEM.
+func issueTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.NilError(t, err)
+
+	certificate, err := x509.ParseCertificate(der)
+	assert.NilError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+
+	return certificate, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestClientCertificate(t *testing.T) {
+	defer setup(t)(t)
+
+	tmpdir := _state.GetRuntimePath()
+
+	ca, caKey, caPEM, _ := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+
+	_, _, serverPEM, serverKeyPEM := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "casaos-gateway"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+
+	_, _, clientPEM, clientKeyPEM := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "app-management"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	options := service.ManagementOptions{
+		Certificate: service.CertificateFiles{
+			CertFile: filepath.Join(tmpdir, "server.crt"),
+			KeyFile:  filepath.Join(tmpdir, "server.key"),
+		},
+		ClientCAFile: filepath.Join(tmpdir, "ca.crt"),
+		Admins:       []string{"cert:app-management"},
+	}
+
+	assert.NilError(t, os.WriteFile(options.Certificate.CertFile, serverPEM, 0o600))
+	assert.NilError(t, os.WriteFile(options.Certificate.KeyFile, serverKeyPEM, 0o600))
+	assert.NilError(t, os.WriteFile(options.ClientCAFile, caPEM, 0o600))
+	assert.NilError(t, _state.SetManagementOptions(options))
+
+	tlsConfig, err := options.TLSConfig()
+	assert.NilError(t, err)
+
+	server := httptest.NewUnstartedServer(_router)
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientFor := func(certificates ...tls.Certificate) *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certificates, MinVersion: tls.VersionTLS12},
+			},
+		}
+	}
+
+	clientCertificate, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	assert.NilError(t, err)
+
+	body, err := json.Marshal(&model.Route{Path: "/test", Target: "http://localhost:8080"})
+	assert.NilError(t, err)
+
+	// no client certificate, no connection
+	_, err = clientFor().Post(server.URL+"/v1/gateway/routes", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.Assert(t, err != nil)
+
+	// with one, no JWT is needed, and the route is owned by the subject of the certificate
+	resp, err := clientFor(clientCertificate).Post(server.URL+"/v1/gateway/routes", echo.MIMEApplicationJSON, bytes.NewReader(body))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	req, _ := http.NewRequest(http.MethodGet, "/v1/gateway/routes", nil)
+	w := httptest.NewRecorder()
+	_router.ServeHTTP(w, req)
+
+	var routes []*service.Route
+	assert.NilError(t, json.NewDecoder(w.Body).Decode(&routes))
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "cert:app-management", routes[0].Owner)
+
+	// and as an admin, it can force a change to the route of someone else
+	assert.NilError(t, _management.CreateRoute(&service.Route{Path: "/other", Target: "http://localhost:8081"}, service.Caller{Identity: "other"}, false))
+
+	for _, force := range []bool{false, true} {
+		expected := http.StatusConflict
+		if force {
+			expected = http.StatusNoContent
+		}
+
+		req, _ = http.NewRequest(http.MethodDelete, server.URL+"/v1/gateway/routes/"+url.PathEscape("/other")+"?force="+strconv.FormatBool(force), nil)
+		resp, err = clientFor(clientCertificate).Do(req)
+		assert.NilError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, expected, resp.StatusCode)
+	}
+}
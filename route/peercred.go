@@ -0,0 +1,43 @@
+package route
+
+import (
+	"context"
+	"net"
+	"os/user"
+	"strconv"
+)
+
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+type peerCredentialsKey struct{}
+
+// WithPeerCredentials is meant for `http.Server.ConnContext`, so that handlers know which process is calling over a
+// Unix socket.
+func WithPeerCredentials(ctx context.Context, conn net.Conn) context.Context {
+	credentials, err := peerCredentials(conn)
+	if err != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, peerCredentialsKey{}, credentials)
+}
+
+func peerCredentialsFrom(ctx context.Context) (*PeerCredentials, bool) {
+	credentials, ok := ctx.Value(peerCredentialsKey{}).(*PeerCredentials)
+	return credentials, ok
+}
+
+// the identity of a Unix socket peer is its user name, or uid if the user cannot be looked up
+func (p *PeerCredentials) Identity() string {
+	uid := strconv.FormatUint(uint64(p.UID), 10)
+
+	if u, err := user.LookupId(uid); err == nil {
+		return "unix:" + u.Username
+	}
+
+	return "unix:" + uid
+}
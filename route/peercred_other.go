@@ -0,0 +1,12 @@
+//go:build !linux
+
+package route
+
+import (
+	"errors"
+	"net"
+)
+
+func peerCredentials(conn net.Conn) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials are only supported on Linux")
+}
@@ -0,0 +1,48 @@
+package route
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+)
+
+// the CA certificate can be downloaded over plain HTTP, because it is not trusted yet when a user needs to download it.
+const caCertificatePath = "/v1/gateway/tls/ca"
+
+type RedirectRoute struct {
+	state *service.State
+}
+
+func NewRedirectRoute(state *service.State) *RedirectRoute {
+	return &RedirectRoute{
+		state: state,
+	}
+}
+
+// Redirect everything to HTTPS at the gateway port, except for the CA certificate, which is served by `gateway`.
+func (r *RedirectRoute) GetRoute(gateway http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == caCertificatePath {
+			gateway.ServeHTTP(w, req)
+			return
+		}
+
+		host := req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = h
+		}
+
+		// IPv6 address needs the brackets back
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		if port := r.state.GetGatewayPort(); port != "443" {
+			host = host + ":" + port
+		}
+
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
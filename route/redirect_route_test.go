@@ -0,0 +1,38 @@
+package route
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IceWhaleTech/CasaOS-Gateway/service"
+	"gotest.tools/v3/assert"
+)
+
+func TestRedirect(t *testing.T) {
+	state := service.NewState()
+	assert.NilError(t, state.SetGatewayPort("8443"))
+
+	gateway := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	router := NewRedirectRoute(state).GetRoute(gateway)
+
+	for url, expected := range map[string]string{
+		"http://casaos.local/":            "https://casaos.local:8443/",
+		"http://192.168.1.2:80/a?b=c":     "https://192.168.1.2:8443/a?b=c",
+		"http://[fe80::1]:8080/v1/users/": "https://[fe80::1]:8443/v1/users/",
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+
+		assert.Equal(t, http.StatusPermanentRedirect, w.Code)
+		assert.Equal(t, expected, w.Header().Get("Location"))
+	}
+
+	// the CA certificate is served over plain HTTP
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://casaos.local"+caCertificatePath, nil))
+	assert.Equal(t, http.StatusTeapot, w.Code)
+}
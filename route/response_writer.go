@@ -0,0 +1,70 @@
+package route
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// responseRecorder remembers the status and size of a response, for metrics and logs.
+type responseRecorder struct {
+	http.ResponseWriter
+
+	status int
+	bytes  int64
+}
+
+func newResponseRecorder(w http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(buf)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// for http.ResponseController
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// for streaming responses, e.g. server-sent events from an app
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// for WebSocket, e.g. the terminal of an app
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+
+	r.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// bodyCounter counts the bytes of a request body as the target reads it - atomically, as the transport can still be
+// reading it after the response.
+type bodyCounter struct {
+	io.ReadCloser
+
+	bytes atomic.Int64
+}
+
+func (b *bodyCounter) Read(buf []byte) (int, error) {
+	n, err := b.ReadCloser.Read(buf)
+	b.bytes.Add(int64(n))
+	return n, err
+}
@@ -12,17 +12,22 @@ import (
 	"github.com/IceWhaleTech/CasaOS-Gateway/service"
 	"github.com/labstack/echo/v4"
 	echo_middleware "github.com/labstack/echo/v4/middleware"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 )
 
 type StaticRoute struct {
-	state *service.State
+	state   *service.State
+	metrics *service.Metrics
+	tracing *service.Tracing
 }
 
 var startTime = time.Now()
 
-func NewStaticRoute(state *service.State) *StaticRoute {
+func NewStaticRoute(state *service.State, metrics *service.Metrics, tracing *service.Tracing) *StaticRoute {
 	return &StaticRoute{
-		state: state,
+		state:   state,
+		metrics: metrics,
+		tracing: tracing,
 	}
 }
 
@@ -101,6 +106,20 @@ var indexRE = regexp.MustCompile(`/($|modules/[^\/]*/($|(index\.(html?|aspx?|cgi
 func (s *StaticRoute) GetRoute() http.Handler {
 	e := echo.New()
 
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			// handle the error here, so that the status is known
+			if err := next(ctx); err != nil {
+				ctx.Error(err)
+			}
+			s.metrics.ObserveStaticRequest(ctx.Response().Status)
+			return nil
+		}
+	})
+	e.Use(otelecho.Middleware(service.TracingServiceName+"-static",
+		otelecho.WithTracerProvider(s.tracing.TracerProvider()),
+		otelecho.WithPropagators(s.tracing.Propagator()),
+	))
 	e.Use(echo_middleware.Gzip())
 	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(ctx echo.Context) error {
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// ManagementOptions controls who can call the management API without a JWT.
+type ManagementOptions struct {
+	// Skip JWT for callers from loopback. Turn it off once all trusted services use the Unix socket.
+	LoopbackBypass bool
+
+	// Where to listen on a Unix socket in addition to loopback TCP. Empty if not used.
+	UnixSocket string
+
+	// Unix socket peers with one of these uids or gids are trusted without JWT.
+	AllowUIDs []uint32
+	AllowGIDs []uint32
+
+	// Where to listen for services on other hosts or containers, which authenticate with client certificates issued by
+	// `ClientCAFile` instead of JWT. Empty if not used.
+	TLSAddress   string
+	Certificate  CertificateFiles
+	ClientCAFile string
+
+	// Caller identities, other than CasaOS users, allowed to act as admin - e.g. `unix:root` or `cert:casaos-app-management`.
+	Admins []string
+}
+
+// TLSConfig for the management listener at `TLSAddress`, which only accepts clients with a certificate from
+// `ClientCAFile`.
+func (o ManagementOptions) TLSConfig() (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(o.Certificate.CertFile, o.Certificate.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := os.ReadFile(o.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(buf) {
+		return nil, errors.New("no certificate found in " + o.ClientCAFile)
+	}
+
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func (o ManagementOptions) AllowsPeer(uid, gid uint32) bool {
+	for _, allowed := range o.AllowUIDs {
+		if uid == allowed {
+			return true
+		}
+	}
+
+	for _, allowed := range o.AllowGIDs {
+		if gid == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (o ManagementOptions) IsAdmin(identity string) bool {
+	for _, admin := range o.Admins {
+		if identity == admin {
+			return true
+		}
+	}
+
+	return false
+}
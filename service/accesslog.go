@@ -0,0 +1,200 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	AccessLogFormatCommon   = "common"
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+)
+
+type AccessLogOptions struct {
+	Enabled bool
+	Format  string
+
+	// rotated by size, keeping `MaxBackups` files for up to `MaxAge` days
+	Filename   string
+	MaxSize    int // megabytes
+	MaxBackups int
+	MaxAge     int // days
+
+	// fraction of requests to log, from 0 to 1, unless a route has its own
+	SampleRate float64
+}
+
+// RouteAccessLog overrides the access log options for a route.
+type RouteAccessLog struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	// fraction of requests to log, from 0 to 1 - 0 for the global rate
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+func (l *RouteAccessLog) validate() error {
+	if l != nil && (l.SampleRate < 0 || l.SampleRate > 1) {
+		return fmt.Errorf("%w: access log sample rate must be between 0 and 1", ErrInvalidRoute)
+	}
+	return nil
+}
+
+type AccessLogEntry struct {
+	RequestID string
+	Time      time.Time
+	ClientIP  string
+	User      string
+	Method    string
+	URI       string
+	Proto     string
+	Status    int
+	Bytes     int64
+	Latency   time.Duration
+	Referer   string
+	UserAgent string
+
+	// empty when no route matched
+	Route  string
+	Target string
+}
+
+// AccessLogger writes an entry for each request served by the gateway, to its own rotated file.
+type AccessLogger struct {
+	options AccessLogOptions
+
+	writer io.WriteCloser
+	json   *zap.Logger
+	mutex  sync.Mutex
+}
+
+func NewAccessLogger(state *State) *AccessLogger {
+	options := state.GetAccessLogOptions()
+
+	logger := &AccessLogger{options: options}
+	if !options.Enabled {
+		return logger
+	}
+
+	logger.writer = &lumberjack.Logger{
+		Filename:   options.Filename,
+		MaxSize:    options.MaxSize,
+		MaxBackups: options.MaxBackups,
+		MaxAge:     options.MaxAge,
+		Compress:   true,
+	}
+
+	if options.Format == AccessLogFormatJSON {
+		encoderConfig := zap.NewProductionEncoderConfig()
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoderConfig.EncodeDuration = zapcore.SecondsDurationEncoder
+		encoderConfig.TimeKey = zapcore.OmitKey // the time the request started is logged instead
+		encoderConfig.LevelKey = zapcore.OmitKey
+		encoderConfig.MessageKey = zapcore.OmitKey
+
+		logger.json = zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(logger.writer), zapcore.InfoLevel))
+	}
+
+	return logger
+}
+
+// Whether a request to `route` (nil if none matched) should be logged, after sampling.
+func (l *AccessLogger) Enabled(route *Route) bool {
+	if !l.options.Enabled {
+		return false
+	}
+
+	sampleRate := l.options.SampleRate
+	if route != nil && route.AccessLog != nil {
+		if route.AccessLog.Disabled {
+			return false
+		}
+		if route.AccessLog.SampleRate > 0 {
+			sampleRate = route.AccessLog.SampleRate
+		}
+	}
+
+	return sampleRate >= 1 || rand.Float64() < sampleRate // #nosec G404 - only for sampling
+}
+
+func (l *AccessLogger) Log(entry *AccessLogEntry) {
+	if l.writer == nil {
+		return
+	}
+
+	if l.json != nil {
+		l.json.Info("",
+			zap.Time("ts", entry.Time),
+			zap.String("request_id", entry.RequestID),
+			zap.String("client_ip", entry.ClientIP),
+			zap.String("user", entry.User),
+			zap.String("method", entry.Method),
+			zap.String("uri", entry.URI),
+			zap.String("proto", entry.Proto),
+			zap.Int("status", entry.Status),
+			zap.Int64("bytes", entry.Bytes),
+			zap.Duration("latency", entry.Latency),
+			zap.String("referer", entry.Referer),
+			zap.String("user_agent", entry.UserAgent),
+			zap.String("route", entry.Route),
+			zap.String("target", entry.Target),
+		)
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, _ = io.WriteString(l.writer, formatAccessLogEntry(entry, l.options.Format)+"\n")
+}
+
+func (l *AccessLogger) Close() error {
+	if l.writer == nil {
+		return nil
+	}
+	return l.writer.Close()
+}
+
+// Common or Combined Log Format, followed by the route, target, latency in seconds and request ID, which those formats do
+// not have.
+func formatAccessLogEntry(entry *AccessLogEntry, format string) string {
+	var b strings.Builder
+
+	bytes := "-"
+	if entry.Bytes > 0 {
+		bytes = strconv.FormatInt(entry.Bytes, 10)
+	}
+
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s",
+		orDash(entry.ClientIP),
+		orDash(entry.User),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.URI+" "+entry.Proto),
+		entry.Status,
+		bytes,
+	)
+
+	if format == AccessLogFormatCombined {
+		fmt.Fprintf(&b, " %s %s", strconv.Quote(orDash(entry.Referer)), strconv.Quote(orDash(entry.UserAgent)))
+	}
+
+	fmt.Fprintf(&b, " %s %s %.6f %s", strconv.Quote(orDash(entry.Route)), strconv.Quote(orDash(entry.Target)), entry.Latency.Seconds(), strconv.Quote(orDash(entry.RequestID)))
+
+	return b.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,534 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+const (
+	ACMEAccountKeyFilename  = "account.key"
+	ACMECertificateFilename = "certificate.crt"
+	ACMEKeyFilename         = "certificate.key"
+
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+
+	acmeCheckInterval = 12 * time.Hour
+	acmeTimeout       = 5 * time.Minute
+
+	// after a failure, doubling up to `acmeCheckInterval` - slow enough for the limits on failed validations of Let's
+	// Encrypt (5 per hour)
+	acmeRetryInterval = 5 * time.Minute
+)
+
+var (
+	ErrACMENotEnabled   = errors.New("ACME is not enabled")
+	ErrACMEInProgress   = errors.New("ACME certificate issuance is already in progress")
+	ErrNoACMEChallenges = errors.New("ACME server offered none of the configured challenge types")
+)
+
+type ACMEOptions struct {
+	Enabled bool
+	Domains []string
+	Email   string
+
+	// e.g. https://acme-v02.api.letsencrypt.org/directory, or https://localhost:14000/dir for Pebble
+	DirectoryURL string
+
+	// An extra CA to trust when talking to the ACME server (Pebble uses its own)
+	CARootFile string
+
+	// Challenge types to use, in order of preference
+	Challenges []string
+
+	// Where the account key and certificate are stored
+	Path string
+
+	RenewBefore time.Duration
+}
+
+func (o ACMEOptions) UsesChallenge(challengeType string) bool {
+	for _, challenge := range o.Challenges {
+		if challenge == challengeType {
+			return true
+		}
+	}
+	return false
+}
+
+type ACMEStatus struct {
+	Enabled      bool      `json:"enabled"`
+	Domains      []string  `json:"domains"`
+	DirectoryURL string    `json:"directory_url"`
+	Issuer       string    `json:"issuer,omitempty"`
+	NotBefore    time.Time `json:"not_before,omitempty"`
+	NotAfter     time.Time `json:"not_after,omitempty"`
+	RenewAt      time.Time `json:"renew_at,omitempty"`
+	InProgress   bool      `json:"in_progress"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// ACMEManager obtains a certificate for the configured domains from an ACME server, by answering HTTP-01 challenges
+// on plain HTTP (see `HTTPHandler`) or TLS-ALPN-01 challenges during TLS handshakes, and renews it before it expires.
+type ACMEManager struct {
+	options ACMEOptions
+
+	certificate *tls.Certificate
+	inProgress  bool
+	lastAttempt time.Time
+	lastError   error
+	mutex       sync.RWMutex
+
+	// pending challenges - HTTP-01 responses by path, and TLS-ALPN-01 certificates by domain
+	httpTokens map[string]string
+	alpnCerts  map[string]*tls.Certificate
+	challenges sync.RWMutex
+
+	cancel context.CancelFunc
+}
+
+func NewACMEManager(state *State) (*ACMEManager, error) {
+	manager := &ACMEManager{
+		options:    state.GetACMEOptions(),
+		httpTokens: make(map[string]string),
+		alpnCerts:  make(map[string]*tls.Certificate),
+	}
+
+	if !manager.options.Enabled {
+		return manager, nil
+	}
+
+	if err := os.MkdirAll(manager.options.Path, 0o700); err != nil {
+		return nil, err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(
+		filepath.Join(manager.options.Path, ACMECertificateFilename),
+		filepath.Join(manager.options.Path, ACMEKeyFilename),
+	)
+	if err == nil {
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+			manager.certificate = &certificate
+		}
+	}
+
+	if err != nil {
+		logger.Info("No ACME certificate is stored yet", zap.Any("reason", err.Error()))
+	}
+
+	return manager, nil
+}
+
+// Check the certificate periodically, and obtain or renew it when needed.
+func (a *ACMEManager) Start() {
+	if !a.options.Enabled {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+
+	go func() {
+		failures := 0
+		for {
+			if a.needsRenewal() {
+				if err := a.Renew(ctx); err != nil {
+					failures++
+					logger.Error("Failed to obtain ACME certificate", zap.Any("error", err), zap.Any("domains", a.options.Domains), zap.Duration("retry_in", acmeRetryDelay(failures)))
+				} else {
+					failures = 0
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(acmeRetryDelay(failures)):
+			}
+		}
+	}()
+}
+
+// how long to wait for the next check after `failures` in a row
+func acmeRetryDelay(failures int) time.Duration {
+	if failures == 0 {
+		return acmeCheckInterval
+	}
+
+	delay := acmeRetryInterval
+	for i := 1; i < failures && delay < acmeCheckInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > acmeCheckInterval {
+		return acmeCheckInterval
+	}
+	return delay
+}
+
+func (a *ACMEManager) Stop() {
+	if a.cancel != nil {
+		a.cancel()
+	}
+}
+
+// Obtain a new certificate now, whether or not the current one needs renewal.
+func (a *ACMEManager) Renew(ctx context.Context) error {
+	if !a.options.Enabled {
+		return ErrACMENotEnabled
+	}
+
+	a.mutex.Lock()
+	if a.inProgress {
+		a.mutex.Unlock()
+		return ErrACMEInProgress
+	}
+	a.inProgress = true
+	a.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, acmeTimeout)
+	defer cancel()
+
+	logger.Info("Obtaining ACME certificate...", zap.Any("domains", a.options.Domains), zap.Any("directory", a.options.DirectoryURL))
+
+	certificate, err := a.obtain(ctx)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.inProgress = false
+	a.lastAttempt = time.Now()
+	a.lastError = err
+
+	if err != nil {
+		return err
+	}
+
+	a.certificate = certificate
+
+	logger.Info("ACME certificate is obtained", zap.Any("domains", a.options.Domains), zap.Any("notAfter", certificate.Leaf.NotAfter))
+
+	return nil
+}
+
+func (a *ACMEManager) Status() ACMEStatus {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	status := ACMEStatus{
+		Enabled:      a.options.Enabled,
+		Domains:      a.options.Domains,
+		DirectoryURL: a.options.DirectoryURL,
+		InProgress:   a.inProgress,
+		LastAttempt:  a.lastAttempt,
+	}
+
+	if a.lastError != nil {
+		status.LastError = a.lastError.Error()
+	}
+
+	if a.certificate != nil {
+		status.Issuer = a.certificate.Leaf.Issuer.String()
+		status.NotBefore = a.certificate.Leaf.NotBefore
+		status.NotAfter = a.certificate.Leaf.NotAfter
+		status.RenewAt = a.certificate.Leaf.NotAfter.Add(-a.options.RenewBefore)
+	}
+
+	return status
+}
+
+// Serve HTTP-01 challenges, and pass everything else to `next`.
+func (a *ACMEManager) HTTPHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.options.Enabled || !strings.HasPrefix(r.URL.Path, "/.well-known/acme-challenge/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		a.challenges.RLock()
+		response, ok := a.httpTokens[r.URL.Path]
+		a.challenges.RUnlock()
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := w.Write([]byte(response)); err != nil {
+			logger.Error("Failed to respond to ACME HTTP-01 challenge", zap.Any("error", err))
+		}
+	})
+}
+
+// Return the certificate for a TLS-ALPN-01 challenge, or the issued certificate if it covers the requested server
+// name. Returns nil (with no error) otherwise, so that another certificate can be used.
+func (a *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !a.options.Enabled {
+		return nil, nil
+	}
+
+	for _, proto := range hello.SupportedProtos {
+		if proto != acme.ALPNProto {
+			continue
+		}
+
+		a.challenges.RLock()
+		defer a.challenges.RUnlock()
+
+		if certificate, ok := a.alpnCerts[strings.ToLower(hello.ServerName)]; ok {
+			return certificate, nil
+		}
+
+		return nil, fmt.Errorf("no pending ACME TLS-ALPN-01 challenge for %s", hello.ServerName)
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.certificate != nil && hello.ServerName != "" && a.certificate.Leaf.VerifyHostname(hello.ServerName) == nil {
+		return a.certificate, nil
+	}
+
+	return nil, nil
+}
+
+func (a *ACMEManager) needsRenewal() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if a.certificate == nil {
+		return true
+	}
+
+	for _, domain := range a.options.Domains {
+		if a.certificate.Leaf.VerifyHostname(domain) != nil {
+			return true
+		}
+	}
+
+	return time.Until(a.certificate.Leaf.NotAfter) < a.options.RenewBefore
+}
+
+func (a *ACMEManager) obtain(ctx context.Context) (*tls.Certificate, error) {
+	client, err := a.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := client.AuthorizeOrder(ctx, acme.DomainIDs(a.options.Domains...))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		if err := a.authorize(ctx, client, authzURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if order, err = client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: a.options.Domains}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	chain, _, err := client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+
+	certPEM := make([]byte, 0)
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := writeKey(filepath.Join(a.options.Path, ACMEKeyFilename), key); err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(a.options.Path, ACMECertificateFilename), certPEM, 0o644); err != nil { // #nosec G306 - certificates are public
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: chain,
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+func (a *ACMEManager) authorize(ctx context.Context, client *acme.Client, authzURL string) error {
+	authz, err := client.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+
+	var challenge *acme.Challenge
+	for _, challengeType := range a.options.Challenges {
+		for _, c := range authz.Challenges {
+			if c.Type == challengeType {
+				challenge = c
+				break
+			}
+		}
+		if challenge != nil {
+			break
+		}
+	}
+
+	if challenge == nil {
+		return fmt.Errorf("%w (%s) for %s", ErrNoACMEChallenges, strings.Join(a.options.Challenges, ", "), authz.Identifier.Value)
+	}
+
+	domain := strings.ToLower(authz.Identifier.Value)
+
+	a.challenges.Lock()
+	switch challenge.Type {
+	case ChallengeHTTP01:
+		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		if err != nil {
+			a.challenges.Unlock()
+			return err
+		}
+		a.httpTokens[client.HTTP01ChallengePath(challenge.Token)] = response
+
+	case ChallengeTLSALPN01:
+		certificate, err := client.TLSALPN01ChallengeCert(challenge.Token, domain)
+		if err != nil {
+			a.challenges.Unlock()
+			return err
+		}
+		a.alpnCerts[domain] = &certificate
+	}
+	a.challenges.Unlock()
+
+	defer func() {
+		a.challenges.Lock()
+		delete(a.httpTokens, client.HTTP01ChallengePath(challenge.Token))
+		delete(a.alpnCerts, domain)
+		a.challenges.Unlock()
+	}()
+
+	logger.Info("Accepting ACME challenge...", zap.Any("domain", domain), zap.Any("type", challenge.Type))
+
+	if _, err := client.Accept(ctx, challenge); err != nil {
+		return err
+	}
+
+	_, err = client.WaitAuthorization(ctx, authz.URI)
+	return err
+}
+
+// Create an ACME client with the stored account key (or a new one), and make sure the account is registered.
+func (a *ACMEManager) client(ctx context.Context) (*acme.Client, error) {
+	key, err := a.accountKey()
+	if err != nil {
+		return nil, err
+	}
+
+	httpClient, err := a.httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		DirectoryURL: a.options.DirectoryURL,
+		HTTPClient:   httpClient,
+		UserAgent:    "casaos-gateway",
+	}
+
+	account := &acme.Account{}
+	if a.options.Email != "" {
+		account.Contact = []string{"mailto:" + a.options.Email}
+	}
+
+	if _, err := client.Register(ctx, account, acme.AcceptTOS); err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (a *ACMEManager) accountKey() (crypto.Signer, error) {
+	filename := filepath.Join(a.options.Path, ACMEAccountKeyFilename)
+
+	if buf, err := os.ReadFile(filename); err == nil {
+		block, _ := pem.Decode(buf)
+		if block == nil {
+			return nil, errors.New("no PEM data found in " + filename)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return key, writeKey(filename, key)
+}
+
+func (a *ACMEManager) httpClient() (*http.Client, error) {
+	if a.options.CARootFile == "" {
+		return http.DefaultClient, nil
+	}
+
+	buf, err := os.ReadFile(a.options.CARootFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	if !roots.AppendCertsFromPEM(buf) {
+		return nil, errors.New("no certificate found in " + a.options.CARootFile)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		},
+	}, nil
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// fakeACMEServer is a minimal stand-in for Pebble, implementing just enough of RFC 8555 for one HTTP-01 order. It
+// validates challenges by asking `gateway` for the key authorization, like an ACME server would over the network.
+type fakeACMEServer struct {
+	*httptest.Server
+
+	gateway http.Handler
+
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+
+	valid   map[string]bool
+	certDER []byte
+	mutex   sync.Mutex
+}
+
+func newFakeACMEServer(t *testing.T, gateway http.Handler) *fakeACMEServer {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NilError(t, err)
+
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NilError(t, err)
+
+	s := &fakeACMEServer{
+		gateway: gateway,
+		caCert:  caCert,
+		caKey:   caKey,
+		valid:   make(map[string]bool),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+func (s *fakeACMEServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", time.Now().UnixNano()))
+
+	var payload map[string]interface{}
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&jws)
+
+		if buf, err := base64.RawURLEncoding.DecodeString(jws.Payload); err == nil && len(buf) > 0 {
+			_ = json.Unmarshal(buf, &payload)
+		}
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(body)
+	}
+
+	switch segments[0] {
+	case "dir":
+		reply(http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+
+	case "nonce":
+		w.WriteHeader(http.StatusOK)
+
+	case "account":
+		w.Header().Set("Location", s.URL+"/account/1")
+		reply(http.StatusCreated, map[string]string{"status": "valid"})
+
+	case "order":
+		if len(segments) == 1 {
+			w.Header().Set("Location", s.URL+"/order/1")
+			reply(http.StatusCreated, s.order("pending"))
+			return
+		}
+		reply(http.StatusOK, s.order("ready"))
+
+	case "authz":
+		domain := segments[1]
+		status := "pending"
+		if s.isValid(domain) {
+			status = "valid"
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": domain},
+			"challenges": []map[string]string{
+				{"type": ChallengeHTTP01, "url": s.URL + "/chal/" + domain, "token": "token-" + domain, "status": status},
+			},
+		})
+
+	case "chal":
+		domain := segments[1]
+
+		w2 := httptest.NewRecorder()
+		s.gateway.ServeHTTP(w2, httptest.NewRequest(http.MethodGet, "http://"+domain+"/.well-known/acme-challenge/token-"+domain, nil))
+
+		status := "invalid"
+		if w2.Code == http.StatusOK && strings.HasPrefix(w2.Body.String(), "token-"+domain+".") {
+			s.mutex.Lock()
+			s.valid[domain] = true
+			s.mutex.Unlock()
+			status = "valid"
+		}
+		reply(http.StatusOK, map[string]string{"type": ChallengeHTTP01, "url": s.URL + "/chal/" + domain, "token": "token-" + domain, "status": status})
+
+	case "finalize":
+		csrDER, _ := base64.RawURLEncoding.DecodeString(payload["csr"].(string))
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			reply(http.StatusBadRequest, map[string]string{"type": "urn:ietf:params:acme:error:badCSR", "detail": err.Error()})
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, s.caCert, csr.PublicKey, s.caKey)
+
+		s.mutex.Lock()
+		s.certDER = der
+		s.mutex.Unlock()
+
+		reply(http.StatusOK, s.order("valid"))
+
+	case "cert":
+		s.mutex.Lock()
+		der := s.certDER
+		s.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		_, _ = w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.caCert.Raw}))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeACMEServer) order(status string) map[string]interface{} {
+	s.mutex.Lock()
+	if s.certDER != nil {
+		status = "valid"
+	}
+	s.mutex.Unlock()
+
+	return map[string]interface{}{
+		"status":         status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": "casaos.example.com"}},
+		"authorizations": []string{s.URL + "/authz/casaos.example.com"},
+		"finalize":       s.URL + "/finalize/1",
+		"certificate":    s.URL + "/cert/1",
+	}
+}
+
+func (s *fakeACMEServer) isValid(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.valid[key]
+}
+
+func TestACMEManager(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-acme-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	var manager *ACMEManager
+
+	gateway := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		manager.HTTPHandler(http.NotFoundHandler()).ServeHTTP(w, r)
+	})
+
+	server := newFakeACMEServer(t, gateway)
+	defer server.Close()
+
+	// trust the fake server as if it was Pebble with its own root
+	caRootFile := filepath.Join(tmpdir, "acme-server.pem")
+	assert.NilError(t, os.WriteFile(caRootFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+
+	state := NewState()
+	assert.NilError(t, state.SetACMEOptions(ACMEOptions{
+		Enabled:      true,
+		Domains:      []string{"casaos.example.com"},
+		DirectoryURL: server.URL + "/dir",
+		CARootFile:   caRootFile,
+		Challenges:   []string{ChallengeTLSALPN01, ChallengeHTTP01}, // the fake server only offers HTTP-01
+		Path:         filepath.Join(tmpdir, "acme"),
+		RenewBefore:  30 * 24 * time.Hour,
+	}))
+
+	var err error
+	manager, err = NewACMEManager(state)
+	assert.NilError(t, err)
+	assert.Assert(t, manager.needsRenewal())
+
+	hello := &tls.ClientHelloInfo{ServerName: "casaos.example.com"}
+
+	certificate, err := manager.GetCertificate(hello)
+	assert.NilError(t, err)
+	assert.Assert(t, certificate == nil)
+
+	assert.NilError(t, manager.Renew(context.Background()))
+
+	status := manager.Status()
+	assert.Equal(t, "", status.LastError)
+	assert.Equal(t, "CN=Fake ACME CA", status.Issuer)
+	assert.Assert(t, status.NotAfter.After(time.Now().Add(60*24*time.Hour)))
+	assert.Assert(t, !manager.needsRenewal())
+
+	certificate, err = manager.GetCertificate(hello)
+	assert.NilError(t, err)
+	assert.Assert(t, certificate != nil)
+	assert.Equal(t, 2, len(certificate.Certificate))
+
+	// no certificate for other names, so that other certificates can be used for them
+	certificate, err = manager.GetCertificate(&tls.ClientHelloInfo{ServerName: "casaos.local"})
+	assert.NilError(t, err)
+	assert.Assert(t, certificate == nil)
+
+	// the certificate is stored, and picked up again on next start
+	manager, err = NewACMEManager(state)
+	assert.NilError(t, err)
+	assert.Assert(t, !manager.needsRenewal())
+	assert.Equal(t, status.NotAfter, manager.Status().NotAfter)
+}
+
+func TestACMEHTTPHandler(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-acme-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	assert.NilError(t, state.SetACMEOptions(ACMEOptions{Enabled: true, Path: tmpdir}))
+
+	manager, err := NewACMEManager(state)
+	assert.NilError(t, err)
+
+	manager.httpTokens["/.well-known/acme-challenge/token"] = "token.thumbprint"
+
+	handler := manager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	for path, expected := range map[string]int{
+		"/.well-known/acme-challenge/token":   http.StatusOK,
+		"/.well-known/acme-challenge/unknown": http.StatusNotFound,
+		"/v1/users":                           http.StatusTeapot,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, expected, w.Code, path)
+	}
+}
+
+func TestACMERetryDelay(t *testing.T) {
+	assert.Equal(t, acmeCheckInterval, acmeRetryDelay(0))
+	assert.Equal(t, 5*time.Minute, acmeRetryDelay(1))
+	assert.Equal(t, 10*time.Minute, acmeRetryDelay(2))
+	assert.Equal(t, 40*time.Minute, acmeRetryDelay(4))
+	assert.Equal(t, acmeCheckInterval, acmeRetryDelay(20))
+}
+
+func TestACMEOptionsUsesChallenge(t *testing.T) {
+	options := ACMEOptions{Challenges: []string{ChallengeTLSALPN01, ChallengeHTTP01}}
+	assert.Assert(t, options.UsesChallenge(ChallengeHTTP01))
+
+	options.Challenges = []string{ChallengeTLSALPN01}
+	assert.Assert(t, !options.UsesChallenge(ChallengeHTTP01))
+}
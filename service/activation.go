@@ -0,0 +1,136 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Names of the sockets passed by systemd, given by `FileDescriptorName=` in the socket unit.
+const (
+	ActivationGateway    = "gateway"
+	ActivationManagement = "management"
+)
+
+var ErrInvalidActivation = errors.New("invalid socket activation")
+
+// Take over the sockets passed by systemd in `files`, named by `LISTEN_FDNAMES` - a `gateway` socket for each address
+// the gateway listens on, and a `management` socket, either TCP or Unix. The files are closed.
+//
+// The gateway sockets replace the listen addresses of the config, see `ActivatedAddresses`.
+func (l *Listeners) Activate(files []*os.File) error {
+	defer closeFiles(files)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, file := range files {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return fmt.Errorf("%w: %s is not a listening socket: %s", ErrInvalidActivation, file.Name(), err.Error())
+		}
+
+		name, err := activatedListenerName(file.Name(), listener)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+
+		if _, ok := l.inherited[name]; ok {
+			listener.Close()
+			return fmt.Errorf("%w: more than one socket for %s", ErrInvalidActivation, name)
+		}
+
+		l.inherited[name] = listener
+		l.activated[name] = true
+	}
+
+	return nil
+}
+
+// Whether the listener `name` is a socket from systemd, which the gateway does not own, e.g. not to remove its file.
+func (l *Listeners) Activated(name string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.activated[name]
+}
+
+// The addresses of the gateway sockets from systemd, each on a port of its own, or none if the gateway is not socket
+// activated.
+func (l *Listeners) ActivatedAddresses() []ListenAddress {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	addresses := make([]ListenAddress, 0)
+	for _, name := range sortedKeys(l.activated) {
+		if !strings.HasPrefix(name, ListenerGatewayPrefix) {
+			continue
+		}
+
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(name, ListenerGatewayPrefix))
+		if err != nil {
+			continue
+		}
+
+		addresses = append(addresses, ListenAddress{Host: host, Port: port})
+	}
+
+	return addresses
+}
+
+// names of the activated listeners, to pass on for an upgrade
+func (l *Listeners) activatedNames() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return sortedKeys(l.activated)
+}
+
+func (l *Listeners) setActivated(names []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, name := range names {
+		l.activated[name] = true
+	}
+}
+
+// the name the listener is known by in the process, e.g. `gateway:[::]:80` for a gateway socket on port 80
+func activatedListenerName(fdName string, listener net.Listener) (string, error) {
+	switch fdName {
+	case ActivationGateway:
+		addr, ok := listener.Addr().(*net.TCPAddr)
+		if !ok {
+			return "", fmt.Errorf("%w: %s socket at %s is not TCP", ErrInvalidActivation, fdName, listener.Addr().String())
+		}
+
+		host := addr.IP.String()
+		if addr.Zone != "" {
+			host += "%" + addr.Zone
+		}
+
+		return GatewayListenerName(ListenAddress{Host: host, Port: fmt.Sprint(addr.Port)}.Address("")), nil
+
+	case ActivationManagement:
+		if _, ok := listener.(*net.UnixListener); ok {
+			return ListenerManagementUnix, nil
+		}
+		return ListenerManagement, nil
+
+	default:
+		return "", fmt.Errorf("%w: unknown socket name %s - expected %s or %s", ErrInvalidActivation, fdName, ActivationGateway, ActivationManagement)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+// a duplicate of the socket of `listener`, named as by `LISTEN_FDNAMES`
+func activationFile(t *testing.T, listener net.Listener, name string) *os.File {
+	file, err := listener.(interface{ File() (*os.File, error) }).File()
+	assert.NilError(t, err)
+	defer file.Close()
+
+	fd, err := syscall.Dup(int(file.Fd()))
+	assert.NilError(t, err)
+
+	return os.NewFile(uintptr(fd), name)
+}
+
+func TestListenersActivate(t *testing.T) {
+	gateway, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer gateway.Close()
+
+	management, err := net.Listen("unix", filepath.Join(t.TempDir(), "management.sock"))
+	assert.NilError(t, err)
+	defer management.Close()
+
+	listeners := NewListeners()
+	assert.NilError(t, listeners.Activate([]*os.File{
+		activationFile(t, gateway, ActivationGateway),
+		activationFile(t, management, ActivationManagement),
+	}))
+
+	port := gateway.Addr().(*net.TCPAddr).Port
+	addresses := listeners.ActivatedAddresses()
+	assert.DeepEqual(t, addresses, []ListenAddress{{Host: "127.0.0.1", Port: strconv.Itoa(port)}})
+	assert.Assert(t, !addresses[0].FollowsGatewayPort())
+
+	// taken over at the address the gateway would listen on for it, whatever the gateway port
+	address := addresses[0].Address("8080")
+	taken, err := listeners.Listen(GatewayListenerName(address), "tcp", address)
+	assert.NilError(t, err)
+	defer taken.Close()
+	assert.Equal(t, taken.Addr().String(), gateway.Addr().String())
+
+	assert.Assert(t, listeners.Inherited(ListenerManagementUnix))
+	assert.Assert(t, listeners.Activated(ListenerManagementUnix))
+	assert.Assert(t, !listeners.Activated(ListenerManagement))
+}
+
+func TestListenersActivateInvalid(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	err = NewListeners().Activate([]*os.File{activationFile(t, listener, "casaos-gateway.socket")})
+	assert.Assert(t, errors.Is(err, ErrInvalidActivation))
+
+	socket, err := net.Listen("unix", filepath.Join(t.TempDir(), "gateway.sock"))
+	assert.NilError(t, err)
+	defer socket.Close()
+
+	err = NewListeners().Activate([]*os.File{activationFile(t, socket, ActivationGateway)})
+	assert.Assert(t, errors.Is(err, ErrInvalidActivation))
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	AuditOperationCreateRoute = "route.create"
+	AuditOperationDeleteRoute = "route.delete"
+	AuditOperationChangePort  = "port.change"
+)
+
+// AuditEntry records one change requested through the management API, whether it succeeded or not.
+type AuditEntry struct {
+	Time      time.Time       `json:"time"`
+	Identity  string          `json:"identity"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	Operation string          `json:"operation"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+type AuditFilter struct {
+	// zero for no limit
+	Since time.Time
+	Until time.Time
+
+	// empty for all operations
+	Operations []string
+}
+
+func (f AuditFilter) Matches(entry *AuditEntry) bool {
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && entry.Time.After(f.Until) {
+		return false
+	}
+
+	if len(f.Operations) == 0 {
+		return true
+	}
+
+	for _, operation := range f.Operations {
+		if entry.Operation == operation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuditLog appends entries as JSON lines to a file that is never rewritten. Without a filename, nothing is recorded.
+type AuditLog struct {
+	filename string
+	mutex    sync.Mutex
+}
+
+func NewAuditLog(filename string) *AuditLog {
+	return &AuditLog{filename: filename}
+}
+
+func (a *AuditLog) Record(entry *AuditEntry) error {
+	if a.filename == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := os.OpenFile(a.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(buf, '\n'))
+	return err
+}
+
+// Returns the entries matching `filter`, oldest first.
+func (a *AuditLog) Query(filter AuditFilter) ([]*AuditEntry, error) {
+	entries := make([]*AuditEntry, 0)
+
+	if a.filename == "" {
+		return entries, nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	file, err := os.Open(a.filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entries, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue // e.g. a line cut short by a crash
+		}
+
+		if filter.Matches(&entry) {
+			entries = append(entries, &entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// returns nil for nil values, so that they are left out of the entry
+func auditValue(value interface{}) json.RawMessage {
+	buf, err := json.Marshal(value)
+	if err != nil || string(buf) == "null" {
+		return nil
+	}
+
+	return buf
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-audit-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+	assert.NilError(t, state.SetAuditLogPath(filepath.Join(tmpdir, "gateway-audit.log")))
+
+	management := NewManagementService(state)
+
+	owner := Caller{Identity: "app-management", ClientIP: "127.0.0.1"}
+	other := Caller{Identity: "other", ClientIP: "127.0.0.1"}
+
+	start := time.Now()
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080"}, owner, false))
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8081"}, owner, false))
+
+	err := management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:6666"}, other, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	assert.NilError(t, management.DeleteRoute("/app", owner, false))
+
+	assert.NilError(t, state.SetGatewayPort("80"))
+	assert.NilError(t, management.SetGatewayPort("8080", Caller{Identity: "user:1", Admin: true, ClientIP: "192.168.1.2"}))
+
+	entries, err := management.GetAuditEntries(AuditFilter{})
+	assert.NilError(t, err)
+	assert.Equal(t, 5, len(entries))
+
+	// repointed route, with before and after
+	var before, after Route
+	assert.NilError(t, json.Unmarshal(entries[1].Before, &before))
+	assert.NilError(t, json.Unmarshal(entries[1].After, &after))
+	assert.Equal(t, "http://localhost:8080", before.Target)
+	assert.Equal(t, "http://localhost:8081", after.Target)
+	assert.Equal(t, "app-management", entries[1].Identity)
+
+	// rejected attempts are recorded too
+	assert.Equal(t, "other", entries[2].Identity)
+	assert.Assert(t, entries[2].Error != "")
+
+	assert.Equal(t, AuditOperationDeleteRoute, entries[3].Operation)
+	assert.Assert(t, entries[3].After == nil)
+
+	// filtered by operation and time
+	entries, err = management.GetAuditEntries(AuditFilter{Operations: []string{AuditOperationChangePort}})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "192.168.1.2", entries[0].ClientIP)
+	assert.Equal(t, `"80"`, string(entries[0].Before))
+	assert.Equal(t, `"8080"`, string(entries[0].After))
+
+	entries, err = management.GetAuditEntries(AuditFilter{Since: start.Add(-time.Hour), Until: start.Add(-time.Minute)})
+	assert.NilError(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// appended to, not replaced, after a restart
+	management = NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080"}, owner, false))
+
+	entries, err = management.GetAuditEntries(AuditFilter{Since: start})
+	assert.NilError(t, err)
+	assert.Equal(t, 6, len(entries))
+}
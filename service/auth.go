@@ -0,0 +1,189 @@
+package service
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidRouteAuth = errors.New("invalid route auth")
+
+// RouteAuth protects a route for apps without authentication of their own. When both are set, basic auth is checked
+// first.
+type RouteAuth struct {
+	Basic   *BasicAuth   `json:"basic,omitempty"`
+	Forward *ForwardAuth `json:"forward,omitempty"`
+}
+
+type BasicAuth struct {
+	Realm       string                `json:"realm,omitempty"`
+	Credentials []BasicAuthCredential `json:"credentials"`
+}
+
+// BasicAuthCredential is registered with either a password or its bcrypt hash. Only the hash is stored.
+type BasicAuthCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// ForwardAuth asks `URL` whether to let a request through, with the headers of the original request. A 2xx response
+// allows it, and any other response is returned to the client instead (e.g. a 401, or a redirect to a login page).
+type ForwardAuth struct {
+	URL string `json:"url"`
+
+	// headers copied from the 2xx response of `URL` to the request sent upstream, e.g. `X-User-ID`
+	ResponseHeaders []string `json:"response_headers,omitempty"`
+}
+
+// Hash the passwords, and check everything else.
+func (a *RouteAuth) prepare() (*RouteAuth, error) {
+	if a == nil {
+		return nil, nil
+	}
+
+	prepared := &RouteAuth{Forward: a.Forward}
+
+	if a.Basic != nil {
+		if len(a.Basic.Credentials) == 0 {
+			return nil, fmt.Errorf("%w: basic auth without credentials", ErrInvalidRouteAuth)
+		}
+
+		prepared.Basic = &BasicAuth{
+			Realm:       a.Basic.Realm,
+			Credentials: make([]BasicAuthCredential, 0, len(a.Basic.Credentials)),
+		}
+
+		usernames := make(map[string]bool, len(a.Basic.Credentials))
+
+		for _, credential := range a.Basic.Credentials {
+			if credential.Username == "" {
+				return nil, fmt.Errorf("%w: basic auth credential without username", ErrInvalidRouteAuth)
+			}
+
+			if usernames[credential.Username] {
+				return nil, fmt.Errorf("%w: more than one basic auth credential for %s", ErrInvalidRouteAuth, credential.Username)
+			}
+			usernames[credential.Username] = true
+
+			hash := credential.Hash
+
+			if credential.Password != "" {
+				buf, err := bcrypt.GenerateFromPassword([]byte(credential.Password), bcrypt.DefaultCost)
+				if err != nil {
+					return nil, err
+				}
+				hash = string(buf)
+			} else if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("%w: basic auth credential for %s needs a password or a bcrypt hash", ErrInvalidRouteAuth, credential.Username)
+			}
+
+			prepared.Basic.Credentials = append(prepared.Basic.Credentials, BasicAuthCredential{
+				Username: credential.Username,
+				Hash:     hash,
+			})
+		}
+	}
+
+	if a.Forward != nil {
+		u, err := url.Parse(a.Forward.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%w: forward auth needs an http(s) URL", ErrInvalidRouteAuth)
+		}
+	}
+
+	return prepared, nil
+}
+
+// The same auth without password hashes, for anyone listing routes.
+func (a *RouteAuth) redacted() *RouteAuth {
+	if a == nil {
+		return nil
+	}
+
+	redacted := &RouteAuth{Forward: a.Forward}
+
+	if a.Basic != nil {
+		redacted.Basic = &BasicAuth{
+			Realm:       a.Basic.Realm,
+			Credentials: make([]BasicAuthCredential, 0, len(a.Basic.Credentials)),
+		}
+
+		for _, credential := range a.Basic.Credentials {
+			redacted.Basic.Credentials = append(redacted.Basic.Credentials, BasicAuthCredential{Username: credential.Username})
+		}
+	}
+
+	return redacted
+}
+
+// Check a username and password against the stored hashes - of every credential for the username, as a routes.json
+// written before they had to be unique can have more than one.
+func (b *BasicAuth) Verify(username, password string) bool {
+	for _, credential := range b.Credentials {
+		if credential.Username == username && credential.Verify(password) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check a password against the stored hash.
+func (c BasicAuthCredential) Verify(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(password)) == nil
+}
+
+// bcrypt is slow on purpose, too slow to run on every request of an app, so credentials verified for a route are
+// remembered, by a digest of the credentials and their hash, until the route is replaced or deleted.
+type verifiedCredentials struct {
+	routes map[string]map[[sha256.Size]byte]struct{}
+	mutex  sync.Mutex
+}
+
+func newVerifiedCredentials() *verifiedCredentials {
+	return &verifiedCredentials{routes: make(map[string]map[[sha256.Size]byte]struct{})}
+}
+
+// Like `BasicAuth.Verify`, every credential for the username is checked.
+func (v *verifiedCredentials) verify(path string, basic *BasicAuth, username, password string) bool {
+	for _, credential := range basic.Credentials {
+		if credential.Username != username {
+			continue
+		}
+
+		key := sha256.Sum256([]byte(credential.Hash + "\x00" + username + "\x00" + password))
+
+		v.mutex.Lock()
+		_, ok := v.routes[path][key]
+		v.mutex.Unlock()
+
+		if ok {
+			return true
+		}
+
+		if credential.Verify(password) {
+			v.mutex.Lock()
+			if v.routes[path] == nil {
+				v.routes[path] = make(map[[sha256.Size]byte]struct{})
+			}
+			v.routes[path][key] = struct{}{}
+			v.mutex.Unlock()
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (v *verifiedCredentials) delete(path string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	delete(v.routes, path)
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+var ErrNoCertificate = errors.New("no certificate is available")
+
+// how long to wait for more changes to certificate files before reloading them (e.g. when a cert and its key are
+// written one after another)
+const certificateReloadDelay = 500 * time.Millisecond
+
+type CertificateFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+type TLSOptions struct {
+	Enabled bool
+
+	// The first one is used when a client does not send SNI, or when no certificate matches its server name.
+	Certificates []CertificateFiles
+
+	// Where to keep the local CA and the server certificate issued from it. Empty if it is not used.
+	SelfSignedPath string
+
+	// Redirect plain HTTP to HTTPS, from `HTTPPort` (or the first available port from 80, if not set)
+	RedirectHTTP bool
+	HTTPPort     string
+}
+
+// CertificateSource provides certificates that are not loaded from files, e.g. the ones issued by ACME. It returns nil
+// without error when it has no certificate for the handshake, so that the next source can be tried.
+type CertificateSource interface {
+	GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error)
+}
+
+// CertificateStore holds the certificates served by the gateway, picks one by SNI, and reloads them when their files
+// change on disk.
+//
+// Reloading only swaps the certificates used for new TLS handshakes, so existing connections are not affected.
+type CertificateStore struct {
+	files        []CertificateFiles
+	certificates []*tls.Certificate
+	sources      []CertificateSource
+	mutex        sync.RWMutex
+
+	// served without any certificate from files, until a source has one, e.g. before ACME issues it
+	temporary *tls.Certificate
+
+	watcher *fsnotify.Watcher
+}
+
+func NewCertificateStore(state *State) (*CertificateStore, error) {
+	options := state.GetTLSOptions()
+
+	store := &CertificateStore{
+		files:        options.Certificates,
+		certificates: make([]*tls.Certificate, 0),
+	}
+
+	if !options.Enabled {
+		return store, nil
+	}
+
+	// the self-signed certificate comes after any configured certificate, so that it is only the default without them.
+	if options.SelfSignedPath != "" {
+		files, err := EnsureSelfSignedCertificate(options.SelfSignedPath)
+		if err != nil {
+			return nil, err
+		}
+		store.files = append(store.files, files)
+	}
+
+	if err := store.Reload(); err != nil {
+		return nil, err
+	}
+
+	// otherwise nothing could be served before ACME issues a certificate, including the challenges it needs for that
+	if len(store.files) == 0 {
+		logger.Info("No certificate is configured - serving a temporary self-signed certificate until one is issued")
+
+		temporary, err := TemporaryCertificate()
+		if err != nil {
+			return nil, err
+		}
+		store.temporary = temporary
+	}
+
+	return store, nil
+}
+
+// Load all certificates from their files again. If any of them fails to load, the certificates in use are kept.
+func (s *CertificateStore) Reload() error {
+	certificates := make([]*tls.Certificate, 0, len(s.files))
+
+	for _, files := range s.files {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return err
+		}
+
+		// parse the leaf once here, instead of on every handshake when matching SNI
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return err
+		}
+
+		certificates = append(certificates, &certificate)
+	}
+
+	s.mutex.Lock()
+	s.certificates = certificates
+	s.mutex.Unlock()
+
+	logger.Info("Certificates are loaded", zap.Any("count", len(certificates)))
+
+	return nil
+}
+
+// Add a source that is asked for a certificate before the ones loaded from files.
+func (s *CertificateStore) AddSource(source CertificateSource) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.sources = append(s.sources, source)
+}
+
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, source := range s.sources {
+		certificate, err := source.GetCertificate(hello)
+		if err != nil || certificate != nil {
+			return certificate, err
+		}
+	}
+
+	if len(s.certificates) == 0 {
+		if s.temporary != nil {
+			return s.temporary, nil
+		}
+		return nil, ErrNoCertificate
+	}
+
+	if hello.ServerName != "" {
+		for _, certificate := range s.certificates {
+			if hello.SupportsCertificate(certificate) == nil {
+				return certificate, nil
+			}
+		}
+	}
+
+	return s.certificates[0], nil
+}
+
+func (s *CertificateStore) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto}, // acme.ALPNProto is for ACME TLS-ALPN-01 challenges
+	}
+}
+
+// Watch the directories of the certificate files, and reload the certificates after any of them changes.
+//
+// Directories are watched instead of files, so that files replaced by rename or through symlinks (as most tools do)
+// are still picked up. Any change in those directories triggers a reload, which is harmless when nothing changed.
+func (s *CertificateStore) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	watched := make(map[string]bool)
+	for _, files := range s.files {
+		for _, file := range []string{files.CertFile, files.KeyFile} {
+			dir := filepath.Dir(file)
+			if watched[dir] {
+				continue
+			}
+
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return err
+			}
+			watched[dir] = true
+		}
+	}
+
+	s.watcher = watcher
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(certificateReloadDelay, func() {
+					if err := s.Reload(); err != nil {
+						logger.Error("Failed to reload certificates - keep using the current ones", zap.Any("error", err))
+					}
+				})
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("Error when watching certificate files", zap.Any("error", err))
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *CertificateStore) Close() error {
+	if s.watcher == nil {
+		return nil
+	}
+	return s.watcher.Close()
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64, dnsNames ...string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+
+	assert.NilError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	assert.NilError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+}
+
+func TestCertificateStore(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-certificate-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	files := []CertificateFiles{
+		{CertFile: filepath.Join(tmpdir, "default.crt"), KeyFile: filepath.Join(tmpdir, "default.key")},
+		{CertFile: filepath.Join(tmpdir, "example.crt"), KeyFile: filepath.Join(tmpdir, "example.key")},
+	}
+
+	writeTestCertificate(t, files[0].CertFile, files[0].KeyFile, 1, "casaos.local")
+	writeTestCertificate(t, files[1].CertFile, files[1].KeyFile, 2, "example.com")
+
+	state := NewState()
+	assert.NilError(t, state.SetTLSOptions(TLSOptions{Enabled: true, Certificates: files}))
+
+	store, err := NewCertificateStore(state)
+	assert.NilError(t, err)
+
+	serialFor := func(serverName string) int64 {
+		certificate, err := store.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:        serverName,
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedVersions: []uint16{tls.VersionTLS13},
+		})
+		assert.NilError(t, err)
+		return certificate.Leaf.SerialNumber.Int64()
+	}
+
+	// selected by SNI, falling back to the first certificate
+	assert.Equal(t, int64(2), serialFor("example.com"))
+	assert.Equal(t, int64(1), serialFor("casaos.local"))
+	assert.Equal(t, int64(1), serialFor("unknown.com"))
+	assert.Equal(t, int64(1), serialFor(""))
+
+	// reloaded when changed on disk
+	assert.NilError(t, store.Watch())
+	defer store.Close()
+
+	writeTestCertificate(t, files[1].CertFile, files[1].KeyFile, 3, "example.com")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serialFor("example.com") != 3 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	assert.Equal(t, int64(3), serialFor("example.com"))
+
+	// a broken certificate does not replace the one in use
+	assert.NilError(t, os.WriteFile(files[1].CertFile, []byte("broken"), 0o600))
+	time.Sleep(2 * certificateReloadDelay)
+	assert.Equal(t, int64(3), serialFor("example.com"))
+}
+
+func TestCertificateStoreTemporary(t *testing.T) {
+	// only ACME, which has not issued a certificate yet
+	state := NewState()
+	assert.NilError(t, state.SetTLSOptions(TLSOptions{Enabled: true}))
+
+	store, err := NewCertificateStore(state)
+	assert.NilError(t, err)
+
+	// e.g. the gateway checking itself by IP, without SNI
+	certificate, err := store.GetCertificate(&tls.ClientHelloInfo{})
+	assert.NilError(t, err)
+	assert.NilError(t, certificate.Leaf.VerifyHostname("127.0.0.1"))
+	assert.Assert(t, time.Until(certificate.Leaf.NotAfter) > 24*time.Hour)
+}
+
+func TestSelfSignedCertificate(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-certificate-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	files, err := EnsureSelfSignedCertificate(tmpdir)
+	assert.NilError(t, err)
+
+	caCert, err := loadCertificate(filepath.Join(tmpdir, CACertFilename))
+	assert.NilError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	serverCert, err := loadCertificate(files.CertFile)
+	assert.NilError(t, err)
+
+	for _, host := range []string{SelfSignedHostname, "localhost", "127.0.0.1"} {
+		_, err = serverCert.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		assert.NilError(t, err)
+	}
+
+	// nothing is reissued when still valid
+	_, err = EnsureSelfSignedCertificate(tmpdir)
+	assert.NilError(t, err)
+
+	sameServerCert, err := loadCertificate(files.CertFile)
+	assert.NilError(t, err)
+	assert.Equal(t, serverCert.SerialNumber.String(), sameServerCert.SerialNumber.String())
+
+	// the server certificate is reissued from the same CA when it is gone
+	assert.NilError(t, os.Remove(files.CertFile))
+
+	_, err = EnsureSelfSignedCertificate(tmpdir)
+	assert.NilError(t, err)
+
+	newServerCert, err := loadCertificate(files.CertFile)
+	assert.NilError(t, err)
+	assert.Assert(t, newServerCert.SerialNumber.String() != serverCert.SerialNumber.String())
+
+	_, err = newServerCert.Verify(x509.VerifyOptions{DNSName: SelfSignedHostname, Roots: roots})
+	assert.NilError(t, err)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var ErrInvalidCORSOptions = errors.New("invalid CORS options")
+
+type CORSOptions struct {
+	// Origins allowed to call the management API. If empty, only the CasaOS UI is allowed, i.e. origins on the gateway
+	// port at this machine - by the host of the request, or by a name or an IP of this machine. `*` allows any origin,
+	// but not with `AllowCredentials`.
+	AllowOrigins []string
+
+	AllowMethods     []string
+	AllowHeaders     []string
+	AllowCredentials bool
+
+	// seconds
+	MaxAge int
+}
+
+func (o CORSOptions) validate() error {
+	if !o.AllowCredentials {
+		return nil
+	}
+
+	for _, allowed := range o.AllowOrigins {
+		if allowed == "*" {
+			return errors.Join(ErrInvalidCORSOptions, errors.New("any origin (`*`) cannot be allowed with credentials"))
+		}
+	}
+
+	return nil
+}
+
+// returns true if `origin` is allowed by the options, for a request to `requestHost` (its `Host` header), where the
+// CasaOS UI is served at any of `gatewayPorts`
+func (o CORSOptions) AllowsOrigin(origin, requestHost string, gatewayPorts []string) bool {
+	if len(o.AllowOrigins) == 0 {
+		return isLocalOrigin(origin, requestHost, gatewayPorts, selfSignedHosts)
+	}
+
+	for _, allowed := range o.AllowOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// whether `origin` is on a gateway port, at the host the request is for or at a name or an IP of this machine
+func isLocalOrigin(origin, requestHost string, gatewayPorts []string, localHosts func() ([]string, []net.IP)) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+
+	onGatewayPort := false
+	for _, gatewayPort := range gatewayPorts {
+		if port != "" && port == gatewayPort {
+			onGatewayPort = true
+		}
+	}
+
+	if !onGatewayPort {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+
+	if requestHostname, _, err := net.SplitHostPort(requestHost); err == nil {
+		requestHost = requestHostname
+	}
+	if host == strings.ToLower(strings.Trim(requestHost, "[]")) {
+		return true
+	}
+
+	dnsNames, ips := localHosts()
+
+	if ip := net.ParseIP(host); ip != nil {
+		for _, localIP := range ips {
+			if ip.Equal(localIP) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, dnsName := range dnsNames {
+		if host == strings.ToLower(dnsName) {
+			return true
+		}
+	}
+
+	return false
+}
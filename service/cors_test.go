@@ -0,0 +1,46 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestIsLocalOrigin(t *testing.T) {
+	localHosts := func() ([]string, []net.IP) {
+		return []string{"casaos.local", "localhost"}, []net.IP{net.ParseIP("192.168.1.2"), net.ParseIP("fd00::2")}
+	}
+
+	gatewayPorts := []string{"80"}
+
+	for _, c := range []struct {
+		origin      string
+		requestHost string
+		allowed     bool
+	}{
+		{"http://192.168.1.2", "casaos.example.com", true},
+		{"http://[fd00::2]", "casaos.example.com", true},
+		{"http://CasaOS.local", "192.168.1.2", true},
+		{"http://casaos.example.com", "casaos.example.com", true},
+		{"http://casaos.example.com", "casaos.example.com:80", true},
+		{"http://[fd00::3]", "[fd00::3]:80", true},
+
+		// on the gateway port, but neither this machine nor the host of the request
+		{"http://evil.com", "192.168.1.2", false},
+		{"http://192.168.1.3", "192.168.1.2", false},
+
+		// this machine, but not the gateway port
+		{"http://192.168.1.2:8080", "192.168.1.2", false},
+		{"https://192.168.1.2", "192.168.1.2", false},
+		{"null", "192.168.1.2", false},
+	} {
+		assert.Equal(t, isLocalOrigin(c.origin, c.requestHost, gatewayPorts, localHosts), c.allowed, c.origin)
+	}
+}
+
+func TestCORSOptionsValidate(t *testing.T) {
+	assert.NilError(t, CORSOptions{AllowOrigins: []string{"*"}}.validate())
+	assert.NilError(t, CORSOptions{AllowOrigins: []string{"https://casaos.example.com"}, AllowCredentials: true}.validate())
+	assert.ErrorContains(t, CORSOptions{AllowOrigins: []string{"*"}, AllowCredentials: true}.validate(), "invalid CORS options")
+}
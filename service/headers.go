@@ -0,0 +1,99 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderOff disables a header for a route, when it is set globally.
+const HeaderOff = "off"
+
+// SecurityHeaders is the policy for security headers added to responses. Each header is only added when the response
+// does not have it already, so an app with its own policy keeps it.
+//
+// In a per-route override, an empty field inherits the global policy, and `off` disables the header.
+type SecurityHeaders struct {
+	// Strict-Transport-Security, only sent when serving TLS, e.g. `max-age=31536000`
+	HSTS string `json:"hsts,omitempty"`
+
+	// X-Content-Type-Options
+	ContentTypeOptions string `json:"content_type_options,omitempty"`
+
+	// Referrer-Policy
+	ReferrerPolicy string `json:"referrer_policy,omitempty"`
+
+	// X-Frame-Options - only DENY or SAMEORIGIN, so prefer `FrameAncestors` for apps embedded in the CasaOS UI
+	FrameOptions string `json:"frame_options,omitempty"`
+
+	// frame-ancestors directive of Content-Security-Policy, e.g. `'self'` for apps embedded in the CasaOS UI
+	FrameAncestors string `json:"frame_ancestors,omitempty"`
+
+	// Content-Security-Policy, with `FrameAncestors` added to it
+	ContentSecurityPolicy string `json:"content_security_policy,omitempty"`
+}
+
+// Return the policy with fields from `override` that are not empty.
+func (h SecurityHeaders) Merge(override *SecurityHeaders) SecurityHeaders {
+	if override == nil {
+		return h
+	}
+
+	pick := func(global, route string) string {
+		if route == "" {
+			return global
+		}
+		return route
+	}
+
+	return SecurityHeaders{
+		HSTS:                  pick(h.HSTS, override.HSTS),
+		ContentTypeOptions:    pick(h.ContentTypeOptions, override.ContentTypeOptions),
+		ReferrerPolicy:        pick(h.ReferrerPolicy, override.ReferrerPolicy),
+		FrameOptions:          pick(h.FrameOptions, override.FrameOptions),
+		FrameAncestors:        pick(h.FrameAncestors, override.FrameAncestors),
+		ContentSecurityPolicy: pick(h.ContentSecurityPolicy, override.ContentSecurityPolicy),
+	}
+}
+
+// Add headers of the policy to `header`, where not present already.
+func (h SecurityHeaders) Apply(header http.Header, tls bool) {
+	setIfAbsent := func(key, value string) {
+		if value == "" || value == HeaderOff || header.Get(key) != "" {
+			return
+		}
+		header.Set(key, value)
+	}
+
+	if tls {
+		setIfAbsent("Strict-Transport-Security", h.HSTS)
+	}
+
+	setIfAbsent("X-Content-Type-Options", h.ContentTypeOptions)
+	setIfAbsent("Referrer-Policy", h.ReferrerPolicy)
+	setIfAbsent("X-Frame-Options", h.FrameOptions)
+
+	directives := make([]string, 0, 2)
+	if h.ContentSecurityPolicy != "" && h.ContentSecurityPolicy != HeaderOff {
+		directives = append(directives, strings.TrimSuffix(strings.TrimSpace(h.ContentSecurityPolicy), ";"))
+	}
+
+	if h.FrameAncestors != "" && h.FrameAncestors != HeaderOff {
+		directives = append(directives, "frame-ancestors "+quoteKeywords(h.FrameAncestors))
+	}
+
+	setIfAbsent("Content-Security-Policy", strings.Join(directives, "; "))
+}
+
+// gateway.ini strips the quotes from a value like `'self'`, so put them back for keywords. (A bare `self` would be a
+// host name, which cannot be meant here.)
+func quoteKeywords(sources string) string {
+	fields := strings.Fields(sources)
+
+	for i, field := range fields {
+		if field == "self" || field == "none" {
+			fields[i] = "'" + field + "'"
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,184 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the servers of the gateway, which must all be up for it to be ready
+const (
+	HealthServerManagement = "management"
+	HealthServerGateway    = "gateway"
+	HealthServerStatic     = "static"
+)
+
+const (
+	HealthStatusOK = "ok"
+
+	// ready, but the targets of some routes cannot be reached, e.g. an app that is stopped
+	HealthStatusDegraded = "degraded"
+
+	HealthStatusUnavailable = "unavailable"
+	HealthStatusFail        = "fail"
+)
+
+// time to connect to the target of each route
+const healthTargetTimeout = 2 * time.Second
+
+type HealthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type RouteHealth struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	HealthCheck
+}
+
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks"`
+	Routes []RouteHealth          `json:"routes"`
+}
+
+// Health tells whether the gateway is ready to serve, from the servers that are up and from what it can check itself.
+type Health struct {
+	management *Management
+
+	servers map[string]bool
+	mutex   sync.RWMutex
+}
+
+func NewHealth(management *Management) *Health {
+	return &Health{
+		management: management,
+		servers: map[string]bool{
+			HealthServerManagement: false,
+			HealthServerGateway:    false,
+			HealthServerStatic:     false,
+		},
+	}
+}
+
+func (h *Health) SetServerUp(server string, up bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.servers[server] = up
+}
+
+// The gateway is ready when its servers are up, the runtime path is writable and `routes.json` was loaded. Routes with
+// a target that cannot be reached make it degraded rather than not ready, as apps can be stopped on purpose.
+func (h *Health) Readiness(ctx context.Context) Readiness {
+	readiness := Readiness{
+		Status: HealthStatusOK,
+		Checks: make(map[string]HealthCheck),
+	}
+
+	h.mutex.RLock()
+	for server, up := range h.servers {
+		check := HealthCheck{Status: HealthStatusOK}
+		if !up {
+			check = HealthCheck{Status: HealthStatusFail, Error: server + " server is not up"}
+		}
+		readiness.Checks[server+"_server"] = check
+	}
+	h.mutex.RUnlock()
+
+	readiness.Checks["runtime_path"] = healthCheckFrom(checkWritable(h.management.State.GetRuntimePath()))
+	readiness.Checks["routes_file"] = healthCheckFrom(h.management.RoutesLoadError())
+
+	for _, check := range readiness.Checks {
+		if check.Status != HealthStatusOK {
+			readiness.Status = HealthStatusUnavailable
+		}
+	}
+
+	readiness.Routes = h.checkRoutes(ctx)
+
+	for _, route := range readiness.Routes {
+		if route.Status != HealthStatusOK && readiness.Status == HealthStatusOK {
+			readiness.Status = HealthStatusDegraded
+		}
+	}
+
+	return readiness
+}
+
+// connect to the target of each route, all at once
+func (h *Health) checkRoutes(ctx context.Context) []RouteHealth {
+	routes := h.management.GetRoutes()
+	results := make([]RouteHealth, len(routes))
+
+	var wg sync.WaitGroup
+	for i, route := range routes {
+		wg.Add(1)
+		go func(i int, route *Route) {
+			defer wg.Done()
+
+			results[i] = RouteHealth{
+				Path:        route.Path,
+				Target:      route.Target,
+				HealthCheck: healthCheckFrom(checkTarget(ctx, route.Target)),
+			}
+		}(i, route)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+
+	return results
+}
+
+func checkTarget(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthTargetTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+func checkWritable(path string) error {
+	file, err := os.CreateTemp(path, ".healthz-*")
+	if err != nil {
+		return err
+	}
+
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
+
+func healthCheckFrom(err error) HealthCheck {
+	if err != nil {
+		return HealthCheck{Status: HealthStatusFail, Error: err.Error()}
+	}
+	return HealthCheck{Status: HealthStatusOK}
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestReadiness(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-health-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	// a target nobody listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	deadTarget := "http://" + listener.Addr().String()
+	listener.Close()
+
+	management := NewManagementService(state)
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: upstream.URL}, Caller{Identity: "app"}, false))
+
+	// not ready until all servers are up
+	management.Health.SetServerUp(HealthServerManagement, true)
+	management.Health.SetServerUp(HealthServerGateway, true)
+
+	readiness := management.Health.Readiness(context.Background())
+	assert.Equal(t, HealthStatusUnavailable, readiness.Status)
+	assert.Equal(t, HealthStatusFail, readiness.Checks["static_server"].Status)
+	assert.Equal(t, HealthStatusOK, readiness.Checks["gateway_server"].Status)
+	assert.Equal(t, HealthStatusOK, readiness.Checks["runtime_path"].Status)
+	assert.Equal(t, HealthStatusOK, readiness.Checks["routes_file"].Status)
+
+	management.Health.SetServerUp(HealthServerStatic, true)
+
+	readiness = management.Health.Readiness(context.Background())
+	assert.Equal(t, HealthStatusOK, readiness.Status)
+	assert.Equal(t, 1, len(readiness.Routes))
+	assert.Equal(t, "/app", readiness.Routes[0].Path)
+	assert.Equal(t, HealthStatusOK, readiness.Routes[0].Status)
+
+	// a target that is down only degrades the gateway
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/dead", Target: deadTarget}, Caller{Identity: "app"}, false))
+
+	readiness = management.Health.Readiness(context.Background())
+	assert.Equal(t, HealthStatusDegraded, readiness.Status)
+	assert.Equal(t, 2, len(readiness.Routes))
+	assert.Equal(t, "/dead", readiness.Routes[1].Path)
+	assert.Equal(t, HealthStatusFail, readiness.Routes[1].Status)
+	assert.Assert(t, readiness.Routes[1].Error != "")
+
+	// unlike a routes.json that cannot be loaded
+	assert.NilError(t, os.WriteFile(filepath.Join(tmpdir, RoutesFile), []byte(`{"/app":`), 0o600))
+
+	management = NewManagementService(state)
+	management.Health.SetServerUp(HealthServerManagement, true)
+	management.Health.SetServerUp(HealthServerGateway, true)
+	management.Health.SetServerUp(HealthServerStatic, true)
+
+	readiness = management.Health.Readiness(context.Background())
+	assert.Equal(t, HealthStatusUnavailable, readiness.Status)
+	assert.Equal(t, HealthStatusFail, readiness.Checks["routes_file"].Status)
+}
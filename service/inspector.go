@@ -0,0 +1,183 @@
+package service
+
+import (
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requests kept for clients of the inspector that connect late
+const InspectorBufferSize = 500
+
+// entries a subscriber can fall behind by before it misses some
+const inspectorSubscriberBuffer = 64
+
+type InspectorEntry struct {
+	ID        uint64    `json:"id"`
+	RequestID string    `json:"request_id"`
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Latency   float64   `json:"latency"` // seconds
+
+	// empty when no route matched
+	Route  string `json:"route,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+type InspectorFilter struct {
+	// the path of a route, as registered
+	Route string
+
+	// e.g. `404` or `5xx`
+	Statuses []string
+
+	// an IP or a network, e.g. `192.168.1.0/24` - not set if not valid
+	ClientIP netip.Prefix
+}
+
+func (f InspectorFilter) Matches(entry InspectorEntry) bool {
+	if f.Route != "" && f.Route != entry.Route {
+		return false
+	}
+
+	if len(f.Statuses) > 0 {
+		matched := false
+		for _, status := range f.Statuses {
+			if matchesStatus(status, entry.Status) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if f.ClientIP.IsValid() {
+		addr, err := netip.ParseAddr(entry.ClientIP)
+		if err != nil || !f.ClientIP.Contains(addr.Unmap()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Whether `status` is a valid filter, i.e. a status code or a class of them like `5xx`.
+func IsValidStatusFilter(status string) bool {
+	if len(status) != 3 {
+		return false
+	}
+
+	if status[1:] == "xx" {
+		return status[0] >= '1' && status[0] <= '5'
+	}
+
+	code, err := strconv.Atoi(status)
+	return err == nil && code >= 100 && code <= 599
+}
+
+func matchesStatus(filter string, status int) bool {
+	if filter[1:] == "xx" {
+		return int(filter[0]-'0') == status/100
+	}
+	return filter == strconv.Itoa(status)
+}
+
+// Inspector keeps the most recent requests through the gateway in a ring buffer, and streams new ones to subscribers.
+type Inspector struct {
+	entries  []InspectorEntry
+	next     int
+	sequence uint64
+
+	subscribers map[*inspectorSubscriber]struct{}
+	mutex       sync.Mutex
+}
+
+type inspectorSubscriber struct {
+	filter  InspectorFilter
+	entries chan InspectorEntry
+}
+
+func NewInspector() *Inspector {
+	return &Inspector{
+		entries:     make([]InspectorEntry, 0, InspectorBufferSize),
+		subscribers: make(map[*inspectorSubscriber]struct{}),
+	}
+}
+
+func (i *Inspector) Record(entry *AccessLogEntry) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.sequence++
+
+	inspectorEntry := InspectorEntry{
+		ID:        i.sequence,
+		RequestID: entry.RequestID,
+		Time:      entry.Time,
+		ClientIP:  entry.ClientIP,
+		Method:    entry.Method,
+		URI:       entry.URI,
+		Status:    entry.Status,
+		Bytes:     entry.Bytes,
+		Latency:   entry.Latency.Seconds(),
+		Route:     entry.Route,
+		Target:    entry.Target,
+	}
+
+	if len(i.entries) < InspectorBufferSize {
+		i.entries = append(i.entries, inspectorEntry)
+	} else {
+		i.entries[i.next] = inspectorEntry
+	}
+	i.next = (i.next + 1) % InspectorBufferSize
+
+	for subscriber := range i.subscribers {
+		if !subscriber.filter.Matches(inspectorEntry) {
+			continue
+		}
+
+		// the gateway does not wait for a subscriber that cannot keep up - it misses entries instead
+		select {
+		case subscriber.entries <- inspectorEntry:
+		default:
+		}
+	}
+}
+
+// Returns the recent entries that match `filter`, oldest first, and a channel of new ones until `cancel` is called.
+func (i *Inspector) Subscribe(filter InspectorFilter) (history []InspectorEntry, entries <-chan InspectorEntry, cancel func()) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	history = make([]InspectorEntry, 0)
+	for n := 0; n < len(i.entries); n++ {
+		// the oldest entry is the next to be overwritten once the buffer is full
+		entry := i.entries[(i.next+n)%len(i.entries)]
+		if filter.Matches(entry) {
+			history = append(history, entry)
+		}
+	}
+
+	subscriber := &inspectorSubscriber{
+		filter:  filter,
+		entries: make(chan InspectorEntry, inspectorSubscriberBuffer),
+	}
+	i.subscribers[subscriber] = struct{}{}
+
+	cancel = func() {
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+
+		delete(i.subscribers, subscriber)
+	}
+
+	return history, subscriber.entries, cancel
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestInspector(t *testing.T) {
+	inspector := NewInspector()
+
+	record := func(route string, status int, clientIP string) {
+		inspector.Record(&AccessLogEntry{Time: time.Now(), Route: route, Status: status, ClientIP: clientIP})
+	}
+
+	// more than the buffer keeps
+	for i := 0; i < InspectorBufferSize+10; i++ {
+		record("/app", 200, "192.168.1.2")
+	}
+
+	history, _, cancel := inspector.Subscribe(InspectorFilter{})
+	cancel()
+
+	assert.Equal(t, InspectorBufferSize, len(history))
+	assert.Equal(t, uint64(11), history[0].ID) // oldest first
+	assert.Equal(t, uint64(InspectorBufferSize+10), history[len(history)-1].ID)
+
+	filter := InspectorFilter{
+		Route:    "/app",
+		Statuses: []string{"5xx", "404"},
+		ClientIP: netip.MustParsePrefix("192.168.1.0/24"),
+	}
+
+	history, entries, cancel := inspector.Subscribe(filter)
+	defer cancel()
+	assert.Equal(t, 0, len(history))
+
+	record("/app", 502, "192.168.1.2")
+	record("/app", 404, "192.168.1.3")
+	record("/app", 403, "192.168.1.2")   // status
+	record("/other", 500, "192.168.1.2") // route
+	record("/app", 500, "10.0.0.1")      // client IP
+
+	assert.Equal(t, 502, (<-entries).Status)
+	assert.Equal(t, 404, (<-entries).Status)
+
+	select {
+	case entry := <-entries:
+		t.Fatalf("unexpected entry %+v", entry)
+	default:
+	}
+
+	// the history is filtered too
+	history, _, cancel = inspector.Subscribe(filter)
+	cancel()
+	assert.Equal(t, 2, len(history))
+
+	for status, valid := range map[string]bool{"5xx": true, "404": true, "6xx": false, "4x": false, "abc": false, "099": false} {
+		assert.Equal(t, valid, IsValidStatusFilter(status), status)
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidListenAddress = errors.New("invalid listen address")
+
+// the host of a listen address on every interface
+const ListenAnyHost = "*"
+
+// ListenAddress is where the gateway listens, on `Port`, or on the gateway port if it is empty.
+type ListenAddress struct {
+	// an IP, or empty for every interface - interface names are resolved to their IPs by `ParseListenAddresses`
+	Host string
+	Port string
+}
+
+// The address to listen on, given the gateway port.
+func (a ListenAddress) Address(gatewayPort string) string {
+	port := a.Port
+	if port == "" {
+		port = gatewayPort
+	}
+	return net.JoinHostPort(a.Host, port)
+}
+
+// Whether the address moves to the new port when the gateway port changes.
+func (a ListenAddress) FollowsGatewayPort() bool {
+	return a.Port == ""
+}
+
+// Parse listen addresses like `*`, `192.168.1.2`, `[::1]:8080` or `eth0`, resolving interface names to the addresses
+// they have now. Without any, the gateway listens on every interface.
+func ParseListenAddresses(entries []string) ([]ListenAddress, error) {
+	return parseListenAddresses(entries, interfaceIPs)
+}
+
+func parseListenAddresses(entries []string, resolve func(name string) ([]string, error)) ([]ListenAddress, error) {
+	if len(entries) == 0 {
+		return []ListenAddress{{}}, nil
+	}
+
+	addresses := make([]ListenAddress, 0, len(entries))
+	seen := make(map[ListenAddress]bool)
+
+	add := func(address ListenAddress) {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	for _, entry := range entries {
+		host, port, err := splitListenAddress(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if host == ListenAnyHost {
+			add(ListenAddress{Port: port})
+			continue
+		}
+
+		if addr, err := netip.ParseAddr(host); err == nil {
+			add(ListenAddress{Host: addr.String(), Port: port})
+			continue
+		}
+
+		ips, err := resolve(host)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s is neither an IP nor an interface with addresses: %s", ErrInvalidListenAddress, entry, err.Error())
+		}
+
+		for _, ip := range ips {
+			add(ListenAddress{Host: ip, Port: port})
+		}
+	}
+
+	if err := checkListenOverlap(addresses); err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+// Listening on every interface and on a specific address on the same port fails for whichever is bound second, so the
+// gateway would start on only some of them.
+func checkListenOverlap(addresses []ListenAddress) error {
+	byPort := make(map[string][]ListenAddress)
+	for _, address := range addresses {
+		byPort[address.Port] = append(byPort[address.Port], address)
+	}
+
+	for _, address := range addresses {
+		if !address.anyHost() || len(byPort[address.Port]) == 1 {
+			continue
+		}
+
+		port := address.Port
+		if port == "" {
+			port = "the gateway port"
+		}
+
+		for _, other := range byPort[address.Port] {
+			if other != address {
+				return fmt.Errorf("%w: %s overlaps with every interface on %s - use one or the other", ErrInvalidListenAddress, other.Host, port)
+			}
+		}
+	}
+
+	return nil
+}
+
+// on every interface, including `0.0.0.0` and `::`
+func (a ListenAddress) anyHost() bool {
+	if a.Host == "" {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(a.Host)
+	return err == nil && addr.IsUnspecified()
+}
+
+// e.g. `::1` is a host only, and `[::1]:8080` a host with a port
+func splitListenAddress(entry string) (host, port string, err error) {
+	if strings.HasPrefix(entry, "[") && strings.HasSuffix(entry, "]") {
+		entry = entry[1 : len(entry)-1]
+	}
+
+	if _, err := netip.ParseAddr(entry); err == nil {
+		return entry, "", nil
+	}
+
+	if !strings.Contains(entry, ":") {
+		return entry, "", nil
+	}
+
+	host, port, err = net.SplitHostPort(entry)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %s", ErrInvalidListenAddress, err.Error())
+	}
+
+	if number, err := strconv.Atoi(port); err != nil || number < 1 || number > 65535 {
+		return "", "", fmt.Errorf("%w: %s has an invalid port", ErrInvalidListenAddress, entry)
+	}
+
+	if host == "" {
+		host = ListenAnyHost
+	}
+
+	return host, port, nil
+}
+
+// the unicast IPs of the interface `name`, with the zone for IPv6 link-local ones
+func interfaceIPs(name string) ([]string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsMulticast() {
+			continue
+		}
+
+		ip := ipNet.IP.String()
+		if ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+			ip += "%" + name
+		}
+
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return nil, errors.New("no addresses")
+	}
+
+	return ips, nil
+}
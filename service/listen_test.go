@@ -0,0 +1,62 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestParseListenAddresses(t *testing.T) {
+	resolve := func(name string) ([]string, error) {
+		if name == "eth0" {
+			return []string{"192.168.1.2", "fe80::1%eth0"}, nil
+		}
+		return nil, errors.New("no such network interface")
+	}
+
+	addresses, err := parseListenAddresses(nil, resolve)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []ListenAddress{{}}, addresses)
+
+	addresses, err = parseListenAddresses([]string{"*", "*:8080", ":8080", "127.0.0.1:8081"}, resolve)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []ListenAddress{
+		{},
+		{Port: "8080"},
+		{Host: "127.0.0.1", Port: "8081"},
+	}, addresses)
+
+	addresses, err = parseListenAddresses([]string{"127.0.0.1", "::1", "[::1]:8443", "eth0:80"}, resolve)
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []ListenAddress{
+		{Host: "127.0.0.1"},
+		{Host: "::1"},
+		{Host: "::1", Port: "8443"},
+		{Host: "192.168.1.2", Port: "80"},
+		{Host: "fe80::1%eth0", Port: "80"},
+	}, addresses)
+
+	assert.Equal(t, "[::]:80", ListenAddress{Host: "::"}.Address("80"))
+	assert.Equal(t, ":80", ListenAddress{}.Address("80"))
+	assert.Equal(t, "[::1]:8443", addresses[2].Address("80"))
+	assert.Assert(t, addresses[1].FollowsGatewayPort())
+	assert.Assert(t, !addresses[2].FollowsGatewayPort())
+
+	// every interface and a specific address on the same port
+	for _, entries := range [][]string{
+		{"*", "127.0.0.1"},
+		{"127.0.0.1:8080", ":8080"},
+		{"0.0.0.0", "::1"},
+		{"*", "::"},
+		{"eth0:80", "*:80"},
+	} {
+		_, err := parseListenAddresses(entries, resolve)
+		assert.Assert(t, errors.Is(err, ErrInvalidListenAddress), entries)
+	}
+
+	for _, entry := range []string{"wlan9", "127.0.0.1:http", "127.0.0.1:0", "[::1:80"} {
+		_, err := parseListenAddresses([]string{entry}, resolve)
+		assert.Assert(t, errors.Is(err, ErrInvalidListenAddress), entry)
+	}
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Names of the listeners of the gateway, handed over from one process to the next.
+const (
+	ListenerManagement     = "management"
+	ListenerManagementUnix = "management-unix"
+	ListenerManagementTLS  = "management-tls"
+	ListenerStatic         = "static"
+	ListenerRedirect       = "redirect"
+
+	// followed by the listen address, as there can be several, e.g. `gateway::80`
+	ListenerGatewayPrefix = "gateway:"
+)
+
+var ErrListenerNotFile = errors.New("listener cannot be passed on as a file")
+
+func GatewayListenerName(address string) string {
+	return ListenerGatewayPrefix + address
+}
+
+// Listeners are the sockets of the process by name, so that they can be passed on to a new process for an upgrade
+// without closing them, and taken over by that process.
+type Listeners struct {
+	// passed on by a previous process, and not claimed yet
+	inherited map[string]net.Listener
+
+	active map[string]net.Listener
+
+	// passed by systemd, see `Activate`
+	activated map[string]bool
+
+	mutex sync.Mutex
+}
+
+func NewListeners() *Listeners {
+	return &Listeners{
+		inherited: make(map[string]net.Listener),
+		active:    make(map[string]net.Listener),
+		activated: make(map[string]bool),
+	}
+}
+
+// Take over the sockets in `files` under `names`, in the same order. The files are closed.
+func InheritListeners(names []string, files []*os.File) (*Listeners, error) {
+	if len(names) != len(files) {
+		return nil, fmt.Errorf("%d listener names for %d files", len(names), len(files))
+	}
+
+	l := NewListeners()
+
+	for i, file := range files {
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			l.CloseInherited()
+			return nil, fmt.Errorf("failed to inherit listener %s: %w", names[i], err)
+		}
+
+		l.inherited[names[i]] = listener
+	}
+
+	return l, nil
+}
+
+// Whether there is a listener by `name` from the previous process, which `Listen` takes over whatever the address.
+func (l *Listeners) Inherited(name string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, ok := l.inherited[name]
+	return ok
+}
+
+// Returns the listener by `name` from the previous process, if any, or listens at `address`.
+func (l *Listeners) Listen(name, network, address string) (net.Listener, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	listener, ok := l.inherited[name]
+	if ok {
+		delete(l.inherited, name)
+		logger.Info("Listener is taken over from previous process", zap.String("name", name), zap.String("address", listener.Addr().String()))
+	} else {
+		var err error
+		if listener, err = net.Listen(network, address); err != nil {
+			return nil, err
+		}
+	}
+
+	l.active[name] = listener
+
+	return listener, nil
+}
+
+// Not to be passed on any more, e.g. as it is closed.
+func (l *Listeners) Forget(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.active, name)
+}
+
+// Close the listeners from the previous process that nothing took over, e.g. as the config changed in between.
+func (l *Listeners) CloseInherited() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name, listener := range l.inherited {
+		logger.Info("Listener from previous process is not used - closing", zap.String("name", name), zap.String("address", listener.Addr().String()))
+		listener.Close()
+		delete(l.inherited, name)
+	}
+}
+
+// Duplicates of the active listeners, sorted by name, for a new process. The caller closes them.
+func (l *Listeners) Files() ([]string, []*os.File, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	names := make([]string, 0, len(l.active))
+	for name := range l.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]*os.File, 0, len(names))
+	for _, name := range names {
+		filer, ok := l.active[name].(interface{ File() (*os.File, error) })
+		if !ok {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("%w: %s", ErrListenerNotFile, name)
+		}
+
+		file, err := filer.File()
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, fmt.Errorf("failed to duplicate listener %s: %w", name, err)
+		}
+
+		files = append(files, file)
+	}
+
+	return names, files, nil
+}
+
+// Whether the socket files of Unix listeners are removed when they are closed - not while the socket is passed on,
+// nor ever for a socket from systemd.
+func (l *Listeners) SetUnlinkOnClose(unlink bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name, listener := range l.active {
+		if l.activated[name] {
+			continue
+		}
+
+		if unixListener, ok := listener.(*net.UnixListener); ok {
+			unixListener.SetUnlinkOnClose(unlink)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestListenersHandOver(t *testing.T) {
+	previous := NewListeners()
+
+	management, err := previous.Listen(ListenerManagement, "tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer management.Close()
+
+	gatewayName := GatewayListenerName("127.0.0.1:0")
+	gateway, err := previous.Listen(gatewayName, "tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer gateway.Close()
+
+	names, files, err := previous.Files()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, names, []string{gatewayName, ListenerManagement})
+
+	next, err := InheritListeners(names, files)
+	assert.NilError(t, err)
+	assert.Assert(t, next.Inherited(ListenerManagement))
+	assert.Assert(t, !next.Inherited(ListenerStatic))
+
+	// the inherited listener is taken over whatever the address
+	taken, err := next.Listen(ListenerManagement, "tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer taken.Close()
+	assert.Equal(t, taken.Addr().String(), management.Addr().String())
+	assert.Assert(t, !next.Inherited(ListenerManagement))
+
+	// the same socket accepts in the new process once the previous one closes its listener
+	management.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := taken.Accept()
+		if err == nil {
+			conn.Close()
+		}
+		accepted <- err
+	}()
+
+	conn, err := net.Dial("tcp", taken.Addr().String())
+	assert.NilError(t, err)
+	conn.Close()
+	assert.NilError(t, <-accepted)
+
+	// not taken over, e.g. as the listen addresses changed
+	next.CloseInherited()
+	assert.Assert(t, !next.Inherited(gatewayName))
+}
+
+func TestListenersForget(t *testing.T) {
+	listeners := NewListeners()
+
+	listener, err := listeners.Listen(ListenerStatic, "tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	defer listener.Close()
+
+	listeners.Forget(ListenerStatic)
+
+	names, files, err := listeners.Files()
+	assert.NilError(t, err)
+	assert.Equal(t, len(names), 0)
+	assert.Equal(t, len(files), 0)
+}
+
+func TestInheritListenersMismatch(t *testing.T) {
+	_, err := InheritListeners([]string{ListenerManagement}, nil)
+	assert.ErrorContains(t, err, "1 listener names for 0 files")
+}
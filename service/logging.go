@@ -0,0 +1,182 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	ErrInvalidLogLevel      = errors.New("invalid log level")
+	ErrInvalidDebugDuration = errors.New("invalid debug duration")
+)
+
+// how long debug logging for a route can last, so that it is not left on by mistake
+const MaxRouteDebugDuration = 24 * time.Hour
+
+type RouteDebug struct {
+	Path  string    `json:"path"`
+	Until time.Time `json:"until"`
+}
+
+// Logging controls the level of the log while running, and turns on debug logging for single routes for a while.
+type Logging struct {
+	level   zap.AtomicLevel
+	outputs []zapcore.WriteSyncer
+
+	// writes at any level - what gets here is decided by `RouteDebugEnabled`
+	debug *zap.Logger
+
+	routes map[string]*routeDebug
+	mutex  sync.RWMutex
+}
+
+type routeDebug struct {
+	until time.Time
+	timer *time.Timer
+}
+
+func NewLogging(level zapcore.Level, outputs ...zapcore.WriteSyncer) *Logging {
+	l := &Logging{
+		level:  zap.NewAtomicLevelAt(level),
+		routes: make(map[string]*routeDebug),
+	}
+
+	for _, output := range outputs {
+		l.outputs = append(l.outputs, &levelFilter{WriteSyncer: output, level: l.level})
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	cores := make([]zapcore.Core, 0, len(outputs))
+	for _, output := range outputs {
+		cores = append(cores, zapcore.NewCore(zapcore.NewConsoleEncoder(encoderConfig), output, zapcore.DebugLevel))
+	}
+	l.debug = zap.New(zapcore.NewTee(cores...))
+
+	return l
+}
+
+// The outputs for the logger of CasaOS-Common, which only drop what is below the current level.
+func (l *Logging) Outputs() []zapcore.WriteSyncer {
+	return l.outputs
+}
+
+func (l *Logging) Level() zapcore.Level {
+	return l.level.Level()
+}
+
+// The logger of CasaOS-Common has no debug lines, so `debug` only turns on `RouteDebugEnabled` for every route.
+func (l *Logging) SetLevel(level string) error {
+	parsed, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("%w: %s - expected debug, info, warn or error", ErrInvalidLogLevel, level)
+	}
+
+	l.level.SetLevel(parsed)
+	logger.Info("Log level changed", zap.String("level", parsed.String()))
+
+	return nil
+}
+
+// Log requests to the route at `path` in detail for `duration`, whatever the level is.
+func (l *Logging) SetRouteDebug(path string, duration time.Duration) (RouteDebug, error) {
+	if duration <= 0 || duration > MaxRouteDebugDuration {
+		return RouteDebug{}, fmt.Errorf("%w: debug logging can last up to %s", ErrInvalidDebugDuration, MaxRouteDebugDuration)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if previous, ok := l.routes[path]; ok {
+		previous.timer.Stop()
+	}
+
+	debug := &routeDebug{until: time.Now().Add(duration)}
+	debug.timer = time.AfterFunc(duration, func() {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+
+		// unless it has been replaced since
+		if l.routes[path] == debug {
+			delete(l.routes, path)
+			logger.Info("Debug logging for route expired", zap.String("path", path))
+		}
+	})
+	l.routes[path] = debug
+
+	logger.Info("Debug logging for route turned on", zap.String("path", path), zap.Time("until", debug.until))
+
+	return RouteDebug{Path: path, Until: debug.until}, nil
+}
+
+func (l *Logging) ClearRouteDebug(path string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if debug, ok := l.routes[path]; ok {
+		debug.timer.Stop()
+		delete(l.routes, path)
+		logger.Info("Debug logging for route turned off", zap.String("path", path))
+	}
+}
+
+func (l *Logging) GetRouteDebugs() []RouteDebug {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	debugs := make([]RouteDebug, 0, len(l.routes))
+	for path, debug := range l.routes {
+		debugs = append(debugs, RouteDebug{Path: path, Until: debug.until})
+	}
+
+	sort.Slice(debugs, func(i, j int) bool { return debugs[i].Path < debugs[j].Path })
+
+	return debugs
+}
+
+// Whether requests to the route at `path` are to be logged in detail, by the level or for the route.
+func (l *Logging) RouteDebugEnabled(path string) bool {
+	if l.level.Enabled(zapcore.DebugLevel) {
+		return true
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	_, ok := l.routes[path]
+	return ok
+}
+
+// Only when `RouteDebugEnabled`.
+func (l *Logging) Debug(message string, fields ...zap.Field) {
+	l.debug.Debug(message, fields...)
+}
+
+// levelFilter drops entries from the logger of CasaOS-Common below the current level. That logger is always at info,
+// so the level is read back from the console encoding, e.g. `2006-01-02T15:04:05.000Z	info	message	{...}`.
+type levelFilter struct {
+	zapcore.WriteSyncer
+
+	level zap.AtomicLevel
+}
+
+func (f *levelFilter) Write(entry []byte) (int, error) {
+	fields := bytes.SplitN(entry, []byte("\t"), 3)
+	if len(fields) == 3 {
+		var level zapcore.Level
+		if err := level.UnmarshalText(fields[1]); err == nil && !f.level.Enabled(level) {
+			return len(entry), nil
+		}
+	}
+
+	return f.WriteSyncer.Write(entry)
+}
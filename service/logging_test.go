@@ -0,0 +1,87 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gotest.tools/assert"
+)
+
+type syncBuffer struct {
+	buffer bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestLogging(t *testing.T) {
+	output := &syncBuffer{}
+	logging := NewLogging(zapcore.InfoLevel, zapcore.AddSync(output))
+
+	logger.LogInitWithWriterSyncers(logging.Outputs()...)
+	defer logger.LogInitConsoleOnly()
+
+	logger.Info("first info")
+
+	err := logging.SetLevel("verbose")
+	assert.Assert(t, errors.Is(err, ErrInvalidLogLevel))
+
+	// only errors from now on
+	assert.NilError(t, logging.SetLevel("error"))
+	assert.Equal(t, zapcore.ErrorLevel, logging.Level())
+
+	logger.Info("second info")
+	logger.Error("first error")
+
+	assert.Assert(t, strings.Contains(output.String(), "first info"))
+	assert.Assert(t, !strings.Contains(output.String(), "second info"))
+	assert.Assert(t, strings.Contains(output.String(), "first error"))
+
+	// debug logging for a route, whatever the level
+	assert.Assert(t, !logging.RouteDebugEnabled("/app"))
+
+	_, err = logging.SetRouteDebug("/app", 48*time.Hour)
+	assert.Assert(t, errors.Is(err, ErrInvalidDebugDuration))
+
+	debug, err := logging.SetRouteDebug("/app", 100*time.Millisecond)
+	assert.NilError(t, err)
+	assert.Equal(t, "/app", debug.Path)
+	assert.Assert(t, logging.RouteDebugEnabled("/app"))
+	assert.Assert(t, !logging.RouteDebugEnabled("/other"))
+	assert.Equal(t, 1, len(logging.GetRouteDebugs()))
+
+	logging.Debug("request to app", zap.String("route", "/app"))
+	assert.Assert(t, strings.Contains(output.String(), "request to app"))
+
+	// until it expires
+	time.Sleep(300 * time.Millisecond)
+	assert.Assert(t, !logging.RouteDebugEnabled("/app"))
+	assert.Equal(t, 0, len(logging.GetRouteDebugs()))
+
+	// or is turned off
+	_, err = logging.SetRouteDebug("/app", time.Hour)
+	assert.NilError(t, err)
+	logging.ClearRouteDebug("/app")
+	assert.Assert(t, !logging.RouteDebugEnabled("/app"))
+
+	// or all requests with the level at debug
+	assert.NilError(t, logging.SetLevel("debug"))
+	assert.Assert(t, logging.RouteDebugEnabled("/other"))
+}
@@ -1,113 +1,463 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/IceWhaleTech/CasaOS-Common/model"
+	"github.com/IceWhaleTech/CasaOS-Common/utils/common_err"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 const RoutesFile = "routes.json"
 
 type Management struct {
-	pathTargetMap       map[string]string
+	pathRouteMap        map[string]*Route
 	pathReverseProxyMap map[string]*httputil.ReverseProxy
+	mutex               sync.RWMutex
 
-	State *State
+	audit *AuditLog
+
+	// by the path of the route, apart from routes, as they are updated on every request
+	stats      map[string]*routeStats
+	statsMutex sync.RWMutex
+
+	slowRequests *slowRequests
+
+	verified *verifiedCredentials
+
+	// why routes.json could not be loaded (fully), if so
+	loadError error
+
+	State     *State
+	Metrics   *Metrics
+	Health    *Health
+	Inspector *Inspector
 }
 
 func NewManagementService(state *State) *Management {
 	routesFilepath := filepath.Join(state.GetRuntimePath(), RoutesFile)
 
 	// try to load routes from routes.json
-	pathTargetMap, err := loadPathTargetMapFrom(routesFilepath)
+	pathRouteMap, err := loadPathRouteMapFrom(routesFilepath)
 	if err != nil {
 		logger.Error("Failed to load routes", zap.Any("error", err), zap.Any("filepath", routesFilepath))
-		pathTargetMap = make(map[string]string)
+		pathRouteMap = make(map[string]*Route)
+	}
+
+	management := &Management{
+		pathRouteMap:        pathRouteMap,
+		pathReverseProxyMap: make(map[string]*httputil.ReverseProxy),
+		audit:               NewAuditLog(state.GetAuditLogPath()),
+		stats:               make(map[string]*routeStats),
+		slowRequests:        newSlowRequests(),
+		verified:            newVerifiedCredentials(),
+		State:               state,
+	}
+
+	// no routes.json yet is a clean start
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		management.loadError = err
 	}
 
-	pathReverseProxyMap := make(map[string]*httputil.ReverseProxy)
+	management.Metrics = NewMetrics(management.routeCount)
+	management.Health = NewHealth(management)
+	management.Inspector = NewInspector()
 
-	for path, target := range pathTargetMap {
-		targetURL, err := url.Parse(target)
+	for path, route := range pathRouteMap {
+		// from a routes.json written when unidentified local callers still owned their routes
+		if route.Owner == OwnerLocal {
+			route.Owner = ""
+		}
+
+		proxy, err := management.newProxy(route)
 		if err != nil {
-			logger.Error("Failed to parse target", zap.Any("error", err), zap.String("target", target))
+			logger.Error("Failed to parse target", zap.Any("error", err), zap.String("target", route.Target))
+			management.loadError = fmt.Errorf("invalid target of route %s: %w", path, err)
 			continue
 		}
-		pathReverseProxyMap[path] = httputil.NewSingleHostReverseProxy(targetURL)
+		management.pathReverseProxyMap[path] = proxy
 	}
 
-	return &Management{
-		pathTargetMap:       pathTargetMap,
-		pathReverseProxyMap: pathReverseProxyMap,
-		State:               state,
-	}
+	return management
 }
 
-func (g *Management) CreateRoute(route *model.Route) error {
-	url, err := url.Parse(route.Target)
+// Create or replace the route at `route.Path`, owned by `caller`.
+//
+// Replacing a route owned by someone else, or a route under one of the reserved paths, is rejected unless `force` is
+// set by an admin.
+func (g *Management) CreateRoute(route *Route, caller Caller, force bool) (err error) {
+	var before *Route
+	defer func() {
+		g.recordAudit(AuditOperationCreateRoute, caller, before.redacted(), route.redacted(), err)
+	}()
+
+	done, err := g.State.beginWrite()
 	if err != nil {
 		return err
 	}
+	defer done()
 
-	g.pathTargetMap[route.Path] = route.Target
-	g.pathReverseProxyMap[route.Path] = httputil.NewSingleHostReverseProxy(url)
+	auth, err := route.Auth.prepare()
+	if err != nil {
+		return err
+	}
 
-	routesFilePath := filepath.Join(g.State.GetRuntimePath(), RoutesFile)
+	if err := route.AccessLog.validate(); err != nil {
+		return err
+	}
+
+	if err := route.SlowRequest.validate(); err != nil {
+		return err
+	}
+
+	route = &Route{
+		Path:        route.Path,
+		Target:      route.Target,
+		Owner:       caller.owner(),
+		Headers:     route.Headers,
+		Auth:        auth,
+		AccessLog:   route.AccessLog,
+		SlowRequest: route.SlowRequest,
+	}
 
-	err = savePathTargetMapTo(routesFilePath, g.pathTargetMap)
+	proxy, err := g.newProxy(route)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	before = g.pathRouteMap[route.Path]
+
+	if err := g.checkOwnership(route.Path, caller, force); err != nil {
+		return err
+	}
+
+	if existing, ok := g.pathRouteMap[route.Path]; ok && existing.Owner != "" && existing.Owner != route.Owner {
+		logger.Info("Route is forced to a new owner", zap.String("path", route.Path), zap.String("from", existing.Owner), zap.String("to", route.Owner))
+	}
+
+	g.pathRouteMap[route.Path] = route
+	g.pathReverseProxyMap[route.Path] = proxy
+
+	// verified with the credentials of the route replaced
+	g.verified.delete(route.Path)
+
+	return g.saveRoutes()
 }
 
-func (g *Management) GetRoutes() []*model.Route {
-	routes := make([]*model.Route, 0)
+// Delete the route at `path`, with the same ownership rules as `CreateRoute`.
+func (g *Management) DeleteRoute(path string, caller Caller, force bool) (err error) {
+	var before *Route
+	defer func() {
+		g.recordAudit(AuditOperationDeleteRoute, caller, before.redacted(), nil, err)
+	}()
 
-	for path, target := range g.pathTargetMap {
-		routes = append(routes, &model.Route{
-			Path:   path,
-			Target: target,
-		})
+	done, err := g.State.beginWrite()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	before, ok := g.pathRouteMap[path]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, path)
+	}
+
+	if err := g.checkOwnership(path, caller, force); err != nil {
+		return err
+	}
+
+	delete(g.pathRouteMap, path)
+	delete(g.pathReverseProxyMap, path)
+
+	g.statsMutex.Lock()
+	delete(g.stats, path)
+	g.statsMutex.Unlock()
+
+	g.slowRequests.delete(path)
+	g.verified.delete(path)
+	g.Metrics.DeleteRoute(path)
+
+	return g.saveRoutes()
+}
+
+func (g *Management) GetRoutes() []*Route {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	routes := make([]*Route, 0)
+
+	for _, route := range g.pathRouteMap {
+		routes = append(routes, route.redacted())
 	}
 
 	return routes
 }
 
+// Routes as from `GetRoutes`, with their stats.
+func (g *Management) GetRoutesWithStats() []*RouteWithStats {
+	routes := g.GetRoutes()
+
+	result := make([]*RouteWithStats, 0, len(routes))
+	for _, route := range routes {
+		result = append(result, &RouteWithStats{Route: route, Stats: g.routeStats(route.Path)})
+	}
+
+	return result
+}
+
+// Requests per second to all the routes over the last `RouteStatsWindow`.
+func (g *Management) RequestRate() float64 {
+	now := time.Now()
+
+	g.statsMutex.RLock()
+	defer g.statsMutex.RUnlock()
+
+	rate := 0.0
+	for _, stats := range g.stats {
+		rate += stats.get(now).RequestRate
+	}
+
+	return rate
+}
+
+// The stats of the route at `path` over the last `RouteStatsWindow`.
+func (g *Management) GetRouteStats(path string) (*RouteStats, error) {
+	g.mutex.RLock()
+	_, ok := g.pathRouteMap[path]
+	g.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrRouteNotFound, path)
+	}
+
+	return g.routeStats(path), nil
+}
+
+// Count a request to the route at `path` in its stats.
+func (g *Management) ObserveRouteRequest(path string, status int, bytesIn, bytesOut int64, latency time.Duration) {
+	now := time.Now()
+
+	g.statsMutex.RLock()
+	stats, ok := g.stats[path]
+	g.statsMutex.RUnlock()
+
+	if !ok {
+		g.statsMutex.Lock()
+		if stats, ok = g.stats[path]; !ok {
+			stats = newRouteStats(now)
+			g.stats[path] = stats
+		}
+		g.statsMutex.Unlock()
+	}
+
+	stats.observe(now, status, bytesIn, bytesOut, latency)
+}
+
+// empty for a route without any request yet
+func (g *Management) routeStats(path string) *RouteStats {
+	now := time.Now()
+
+	g.statsMutex.RLock()
+	stats, ok := g.stats[path]
+	g.statsMutex.RUnlock()
+
+	if !ok {
+		return newRouteStats(now).get(now)
+	}
+
+	return stats.get(now)
+}
+
+// How long the target of `route` can take before a request to it is slow, or 0 if none is.
+// Check a username and password against the basic auth of `route`, remembering them once verified.
+func (g *Management) VerifyBasicAuth(route *Route, username, password string) bool {
+	return g.verified.verify(route.Path, route.Auth.Basic, username, password)
+}
+
+func (g *Management) SlowRequestThreshold(route *Route) time.Duration {
+	threshold := g.State.GetSlowRequestThreshold()
+	if route.SlowRequest != nil {
+		if route.SlowRequest.Disabled {
+			return 0
+		}
+		if route.SlowRequest.Threshold > 0 {
+			threshold = time.Duration(route.SlowRequest.Threshold * float64(time.Second))
+		}
+	}
+
+	return threshold
+}
+
+// Count a request to the route at `path` that took longer than `threshold`, keeping it with the most recent ones.
+func (g *Management) ObserveSlowRequest(path string, threshold time.Duration, request SlowRequest) {
+	g.Metrics.ObserveSlowRequest(path)
+	g.slowRequests.record(path, threshold, request)
+}
+
+// Slow requests since the gateway started, by route, with the most first.
+func (g *Management) GetSlowRequests() []RouteSlowRequests {
+	return g.slowRequests.get()
+}
+
+// The error from loading routes.json when the gateway started, or nil if it was loaded cleanly.
+func (g *Management) RoutesLoadError() error {
+	return g.loadError
+}
+
+func (g *Management) routeCount() int {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
+	return len(g.pathRouteMap)
+}
+
 func (g *Management) GetProxy(path string) *httputil.ReverseProxy {
+	_, proxy := g.Match(path)
+	return proxy
+}
+
+// Returns the route matching `path` with its proxy, or nil for both without any match.
+//
+// The route is the one in use, so it must not be changed.
+func (g *Management) Match(path string) (*Route, *httputil.ReverseProxy) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+
 	// sort paths by length in descending order
 	// (without this step, a path like "/abcd" can potentially be matched with "/ab")
 	paths := getSortedKeys(g.pathReverseProxyMap)
 
 	for _, p := range paths {
 		if strings.HasPrefix(path, p) {
-			return g.pathReverseProxyMap[p]
+			return g.pathRouteMap[p], g.pathReverseProxyMap[p]
 		}
 	}
-	return nil
+	return nil, nil
 }
 
 func (g *Management) GetGatewayPort() string {
 	return g.State.GetGatewayPort()
 }
 
-func (g *Management) SetGatewayPort(port string) error {
-	if err := g.State.SetGatewayPort(port); err != nil {
-		return err
+func (g *Management) SetGatewayPort(port string, caller Caller) error {
+	before := g.State.GetGatewayPort()
+
+	done, err := g.State.beginWrite()
+	if err == nil {
+		err = g.State.SetGatewayPort(port)
+		done()
+	}
+
+	g.recordAudit(AuditOperationChangePort, caller, before, port, err)
+
+	return err
+}
+
+func (g *Management) GetAuditEntries(filter AuditFilter) ([]*AuditEntry, error) {
+	return g.audit.Query(filter)
+}
+
+func (g *Management) recordAudit(operation string, caller Caller, before, after interface{}, err error) {
+	entry := &AuditEntry{
+		Time:      time.Now(),
+		Identity:  caller.Identity,
+		ClientIP:  caller.ClientIP,
+		Operation: operation,
+		Before:    auditValue(before),
+		After:     auditValue(after),
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	if err := g.audit.Record(entry); err != nil {
+		logger.Error("Failed to write audit log", zap.Any("error", err), zap.Any("operation", operation), zap.Any("identity", caller.Identity))
+	}
+}
+
+func (g *Management) newProxy(route *Route) (*httputil.ReverseProxy, error) {
+	targetURL, err := url.Parse(route.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+
+	// times each phase of the request to the target, for slow requests
+	proxy.Transport = &timedTransport{RoundTripper: http.DefaultTransport}
+
+	proxy.ModifyResponse = func(response *http.Response) error {
+		// the outgoing request is a shallow copy of the incoming one, so it tells whether the client is on TLS.
+		g.State.GetSecurityHeaders().Merge(route.Headers).Apply(response.Header, response.Request.TLS != nil)
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// a client going away is not a problem with the target
+		if !errors.Is(err, context.Canceled) {
+			g.Metrics.ObserveUpstreamError(route.Path)
+			trace.SpanFromContext(r.Context()).RecordError(err)
+			logger.Error("Failed to proxy request", zap.Any("error", err), zap.String("path", route.Path), zap.String("target", route.Target), zap.String("request_id", RequestIDFrom(r.Context())))
+		}
+
+		WriteError(w, r, http.StatusBadGateway, common_err.SERVICE_ERROR, "failed to reach the target of route "+route.Path)
+	}
+
+	return proxy, nil
+}
+
+// must be called with the lock held
+func (g *Management) checkOwnership(path string, caller Caller, force bool) error {
+	if caller.Identity == OwnerGateway {
+		return nil
+	}
+
+	if force {
+		if !caller.Admin {
+			return ErrForceNotAllowed
+		}
+		return nil
+	}
+
+	if isReservedPath(path, g.State.GetReservedPaths()) {
+		return fmt.Errorf("%w: %s", ErrRouteReserved, path)
+	}
+
+	// routes without an owner were registered by an unidentified caller, or loaded from a routes.json written before
+	// ownership existed - let anyone claim them. An unidentified caller owns nothing, so it cannot change any other.
+	if existing, ok := g.pathRouteMap[path]; ok && existing.Owner != "" && existing.Owner != caller.owner() {
+		return fmt.Errorf("%w: %s is owned by %s", ErrRouteConflict, path, existing.Owner)
 	}
 
 	return nil
 }
 
+// must be called with the lock held
+func (g *Management) saveRoutes() error {
+	routesFilePath := filepath.Join(g.State.GetRuntimePath(), RoutesFile)
+	return savePathRouteMapTo(routesFilePath, g.pathRouteMap)
+}
+
 func getSortedKeys[V any](m map[string]V) []string {
 	keys := make([]string, 0, len(m))
 
@@ -120,23 +470,41 @@ func getSortedKeys[V any](m map[string]V) []string {
 	return keys
 }
 
-func loadPathTargetMapFrom(routesFilepath string) (map[string]string, error) {
+func loadPathRouteMapFrom(routesFilepath string) (map[string]*Route, error) {
 	content, err := os.ReadFile(routesFilepath)
 	if err != nil {
 		return nil, err
 	}
 
-	pathTargetMap := make(map[string]string)
-	err = json.Unmarshal(content, &pathTargetMap)
+	entries := make(map[string]json.RawMessage)
+	err = json.Unmarshal(content, &entries)
 	if err != nil {
 		return nil, err
 	}
 
-	return pathTargetMap, nil
+	pathRouteMap := make(map[string]*Route)
+	for path, entry := range entries {
+		// routes.json written by earlier versions maps each path to its target only
+		var target string
+		if err := json.Unmarshal(entry, &target); err == nil {
+			pathRouteMap[path] = &Route{Path: path, Target: target}
+			continue
+		}
+
+		var route Route
+		if err := json.Unmarshal(entry, &route); err != nil {
+			return nil, err
+		}
+		route.Path = path
+
+		pathRouteMap[path] = &route
+	}
+
+	return pathRouteMap, nil
 }
 
-func savePathTargetMapTo(routesFilepath string, pathTargetMap map[string]string) error {
-	content, err := json.Marshal(pathTargetMap)
+func savePathRouteMapTo(routesFilepath string, pathRouteMap map[string]*Route) error {
+	content, err := json.Marshal(pathRouteMap)
 	if err != nil {
 		return err
 	}
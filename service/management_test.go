@@ -1,13 +1,17 @@
 package service
 
 import (
+	"crypto/tls"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
 	"testing"
 
-	"github.com/IceWhaleTech/CasaOS-Common/model"
 	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"golang.org/x/crypto/bcrypt"
 	"gotest.tools/assert"
 )
 
@@ -36,12 +40,12 @@ func TestRoutesPersistence(t *testing.T) {
 
 	management := NewManagementService(state1)
 
-	route := &model.Route{
+	route := &Route{
 		Path:   "/test",
 		Target: "http://localhost:8080",
 	}
 
-	if err := management.CreateRoute(route); err != nil {
+	if err := management.CreateRoute(route, Caller{Identity: OwnerLocal}, false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -54,6 +58,147 @@ func TestRoutesPersistence(t *testing.T) {
 	assert.Equal(t, 1, len(routes))
 	assert.Equal(t, "/test", routes[0].Path)
 	assert.Equal(t, "http://localhost:8080", routes[0].Target)
+	assert.Equal(t, "", routes[0].Owner)
+}
+
+func TestLegacyRoutesFile(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	if err := os.WriteFile(filepath.Join(tmpdir, RoutesFile), []byte(`{"/test":"http://localhost:8080"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+	routes := management.GetRoutes()
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "http://localhost:8080", routes[0].Target)
+	assert.Equal(t, "", routes[0].Owner)
+
+	// a route without owner can be claimed by anyone
+	err := management.CreateRoute(&Route{Path: "/test", Target: "http://localhost:8081"}, Caller{Identity: "app"}, false)
+	assert.NilError(t, err)
+	assert.Equal(t, "app", management.GetRoutes()[0].Owner)
+}
+
+func TestRouteOwnership(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.SetReservedPaths([]string{"/", "/v1/gateway"}); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+
+	owner := Caller{Identity: "app-management"}
+	other := Caller{Identity: "other"}
+	admin := Caller{Identity: "user:1", Admin: true}
+
+	route := &Route{Path: "/v2/app_management", Target: "http://localhost:8080"}
+	assert.NilError(t, management.CreateRoute(route, owner, false))
+
+	// the owner can update its own route
+	assert.NilError(t, management.CreateRoute(route, owner, false))
+
+	// someone else cannot, not even by force
+	err := management.CreateRoute(&Route{Path: route.Path, Target: "http://localhost:6666"}, other, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	err = management.CreateRoute(&Route{Path: route.Path, Target: "http://localhost:6666"}, other, true)
+	assert.Assert(t, errors.Is(err, ErrForceNotAllowed))
+
+	err = management.DeleteRoute(route.Path, other, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	// reserved paths are protected, even when they are not registered yet
+	err = management.CreateRoute(&Route{Path: "/", Target: "http://localhost:6666"}, owner, false)
+	assert.Assert(t, errors.Is(err, ErrRouteReserved))
+
+	err = management.CreateRoute(&Route{Path: "/v1/gateway/routes", Target: "http://localhost:6666"}, owner, false)
+	assert.Assert(t, errors.Is(err, ErrRouteReserved))
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/v1/gatewayx", Target: "http://localhost:6666"}, owner, false))
+
+	// an admin can force
+	assert.NilError(t, management.CreateRoute(&Route{Path: route.Path, Target: "http://localhost:6666"}, admin, true))
+	assert.Equal(t, "http://localhost:6666", findRoute(management, route.Path).Target)
+	assert.Equal(t, admin.Identity, findRoute(management, route.Path).Owner)
+
+	err = management.DeleteRoute(route.Path, owner, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	assert.NilError(t, management.DeleteRoute(route.Path, admin, false))
+	assert.Assert(t, findRoute(management, route.Path) == nil)
+
+	err = management.DeleteRoute(route.Path, admin, false)
+	assert.Assert(t, errors.Is(err, ErrRouteNotFound))
+}
+
+func TestLocalCallerOwnership(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	// owned by an unidentified local caller, before it lost ownership
+	if err := os.WriteFile(filepath.Join(tmpdir, RoutesFile), []byte(`{"/legacy":{"target":"http://localhost:8080","owner":"local"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+	assert.Equal(t, "", findRoute(management, "/legacy").Owner)
+
+	local := Caller{Identity: OwnerLocal}
+	app := Caller{Identity: "app"}
+
+	// an unidentified caller can register a route, but does not own it
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/local", Target: "http://localhost:8080"}, local, false))
+	assert.Equal(t, "", findRoute(management, "/local").Owner)
+
+	// so anyone can claim it, and then the unidentified caller cannot change it any more
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/local", Target: "http://localhost:8081"}, app, false))
+	assert.Equal(t, app.Identity, findRoute(management, "/local").Owner)
+
+	err := management.CreateRoute(&Route{Path: "/local", Target: "http://localhost:6666"}, local, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	err = management.DeleteRoute("/local", local, false)
+	assert.Assert(t, errors.Is(err, ErrRouteConflict))
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/legacy", Target: "http://localhost:8081"}, app, false))
+	assert.Equal(t, app.Identity, findRoute(management, "/legacy").Owner)
+}
+
+func findRoute(management *Management, path string) *Route {
+	for _, route := range management.GetRoutes() {
+		if route.Path == path {
+			return route
+		}
+	}
+	return nil
 }
 
 func TestPathSorting(t *testing.T) {
@@ -78,10 +223,10 @@ func TestPathSorting(t *testing.T) {
 	}
 
 	for path, target := range routes {
-		if err := management.CreateRoute(&model.Route{
+		if err := management.CreateRoute(&Route{
 			Path:   path,
 			Target: target,
-		}); err != nil {
+		}, GatewayCaller, false); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -99,3 +244,177 @@ func TestPathSorting(t *testing.T) {
 		assert.Equal(t, target, req.URL.String())
 	}
 }
+
+func TestSecurityHeaders(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/own" {
+			w.Header().Set("Referrer-Policy", "no-referrer")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := state.SetSecurityHeaders(SecurityHeaders{
+		HSTS:               "max-age=31536000",
+		ContentTypeOptions: "nosniff",
+		ReferrerPolicy:     "strict-origin-when-cross-origin",
+		FrameAncestors:     "self", // as read from gateway.ini, which strips the quotes
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/", Target: upstream.URL}, GatewayCaller, false))
+	assert.NilError(t, management.CreateRoute(&Route{
+		Path:   "/app",
+		Target: upstream.URL,
+		Headers: &SecurityHeaders{
+			ContentTypeOptions:    HeaderOff,
+			FrameAncestors:        "'self' http://casaos.local",
+			ContentSecurityPolicy: "default-src 'self';",
+		},
+	}, GatewayCaller, false))
+
+	get := func(path string, secure bool) http.Header {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if secure {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		w := httptest.NewRecorder()
+		management.GetProxy(path).ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		return w.Header()
+	}
+
+	header := get("/", false)
+	assert.Equal(t, "", header.Get("Strict-Transport-Security"))
+	assert.Equal(t, "nosniff", header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "strict-origin-when-cross-origin", header.Get("Referrer-Policy"))
+	assert.Equal(t, "", header.Get("X-Frame-Options"))
+	assert.Equal(t, "frame-ancestors 'self'", header.Get("Content-Security-Policy"))
+
+	header = get("/own", true)
+	assert.Equal(t, "max-age=31536000", header.Get("Strict-Transport-Security"))
+	assert.Equal(t, "no-referrer", header.Get("Referrer-Policy"))
+
+	header = get("/app", false)
+	assert.Equal(t, "", header.Get("X-Content-Type-Options"))
+	assert.Equal(t, "strict-origin-when-cross-origin", header.Get("Referrer-Policy"))
+	assert.Equal(t, "default-src 'self'; frame-ancestors 'self' http://casaos.local", header.Get("Content-Security-Policy"))
+}
+
+func TestSuspendWrites(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+	caller := Caller{Identity: "app"}
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/test", Target: "http://localhost:8080"}, caller, false))
+
+	state.SuspendWrites()
+
+	err := management.CreateRoute(&Route{Path: "/other", Target: "http://localhost:8080"}, caller, false)
+	assert.Assert(t, errors.Is(err, ErrWritesSuspended))
+
+	err = management.DeleteRoute("/test", caller, false)
+	assert.Assert(t, errors.Is(err, ErrWritesSuspended))
+
+	err = management.SetGatewayPort("8080", caller)
+	assert.Assert(t, errors.Is(err, ErrWritesSuspended))
+
+	// nothing changed for a new process to miss
+	routes := NewManagementService(state).GetRoutes()
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "/test", routes[0].Path)
+
+	state.ResumeWrites()
+
+	assert.NilError(t, management.DeleteRoute("/test", caller, false))
+}
+
+func TestBasicAuthDuplicateUsernames(t *testing.T) {
+	hash := func(password string) string {
+		buf, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		assert.NilError(t, err)
+		return string(buf)
+	}
+
+	// as in a routes.json written before usernames had to be unique
+	basic := &BasicAuth{Credentials: []BasicAuthCredential{
+		{Username: "casaos", Hash: hash("first")},
+		{Username: "casaos", Hash: hash("second")},
+	}}
+	route := &Route{Path: "/test", Auth: &RouteAuth{Basic: basic}}
+
+	verified := newVerifiedCredentials()
+	for _, password := range []string{"first", "second", "second"} {
+		assert.Assert(t, verified.verify(route.Path, basic, "casaos", password), password)
+		assert.Assert(t, basic.Verify("casaos", password), password)
+	}
+
+	assert.Assert(t, !verified.verify(route.Path, basic, "casaos", "third"))
+	assert.Assert(t, !basic.Verify("casaos", "third"))
+}
+
+func TestVerifiedCredentialsCleared(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-route-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	if err := state.SetRuntimePath(tmpdir); err != nil {
+		t.Fatal(err)
+	}
+
+	management := NewManagementService(state)
+	caller := Caller{Identity: "app"}
+
+	create := func(password string) *Route {
+		assert.NilError(t, management.CreateRoute(&Route{
+			Path:   "/test",
+			Target: "http://localhost:8080",
+			Auth:   &RouteAuth{Basic: &BasicAuth{Credentials: []BasicAuthCredential{{Username: "casaos", Password: password}}}},
+		}, caller, false))
+		route, _ := management.Match("/test")
+		return route
+	}
+
+	route := create("old")
+	assert.Assert(t, management.VerifyBasicAuth(route, "casaos", "old"))
+	assert.Equal(t, 1, len(management.verified.routes["/test"]))
+
+	// nothing is kept for the credentials before
+	route = create("new")
+	assert.Equal(t, 0, len(management.verified.routes["/test"]))
+	assert.Assert(t, !management.VerifyBasicAuth(route, "casaos", "old"))
+	assert.Assert(t, management.VerifyBasicAuth(route, "casaos", "new"))
+
+	assert.NilError(t, management.DeleteRoute("/test", caller, false))
+	_, ok := management.verified.routes["/test"]
+	assert.Assert(t, !ok)
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsNamespace = "casaos_gateway"
+
+	// the route label of requests that match no registered route, e.g. `/ping` or a 404
+	MetricsRouteNone = "none"
+)
+
+// Metrics of the gateway, in Prometheus exposition format at `Handler()`.
+//
+// Requests are labelled by the registered route they matched, never by their path, so the number of series is bounded
+// by the routes.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests       *prometheus.CounterVec
+	duration       *prometheus.HistogramVec
+	inFlight       prometheus.Gauge
+	upstreamErrors *prometheus.CounterVec
+	slowRequests   *prometheus.CounterVec
+	reloads        *prometheus.CounterVec
+	staticHits     *prometheus.CounterVec
+}
+
+func NewMetrics(routeCount func() int) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_total",
+			Help:      "Requests to the gateway, by route, method and status.",
+		}, []string{"route", "method", "status"}),
+
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time to serve requests to the gateway, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "requests_in_flight",
+			Help:      "Requests being served by the gateway.",
+		}),
+
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_errors_total",
+			Help:      "Requests that could not be proxied to the target of their route.",
+		}, []string{"route"}),
+
+		slowRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "slow_requests_total",
+			Help:      "Requests whose target took longer than the slow request threshold of their route.",
+		}, []string{"route"}),
+
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reloads_total",
+			Help:      "Gateway restarts on a new port, by result.",
+		}, []string{"result"}),
+
+		staticHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "static_requests_total",
+			Help:      "Requests to the static web, by status.",
+		}, []string{"status"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.inFlight,
+		m.upstreamErrors,
+		m.slowRequests,
+		m.reloads,
+		m.staticHits,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "routes",
+			Help:      "Registered routes.",
+		}, func() float64 { return float64(routeCount()) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Count a request as in flight until the returned function is called.
+func (m *Metrics) RequestStarted() func() {
+	m.inFlight.Inc()
+	return m.inFlight.Dec
+}
+
+func (m *Metrics) ObserveRequest(route, method string, status int, duration time.Duration) {
+	if route == "" {
+		route = MetricsRouteNone
+	}
+
+	method = metricsMethod(method)
+
+	m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	m.duration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveUpstreamError(route string) {
+	m.upstreamErrors.WithLabelValues(route).Inc()
+}
+
+func (m *Metrics) ObserveSlowRequest(route string) {
+	m.slowRequests.WithLabelValues(route).Inc()
+}
+
+// Drop the series of a deleted route, so that routes of apps come and gone do not pile up.
+func (m *Metrics) DeleteRoute(route string) {
+	m.requests.DeletePartialMatch(prometheus.Labels{"route": route})
+	m.duration.DeletePartialMatch(prometheus.Labels{"route": route})
+	m.upstreamErrors.DeleteLabelValues(route)
+	m.slowRequests.DeleteLabelValues(route)
+}
+
+func (m *Metrics) ObserveReload(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	m.reloads.WithLabelValues(result).Inc()
+}
+
+func (m *Metrics) ObserveStaticRequest(status int) {
+	m.staticHits.WithLabelValues(strconv.Itoa(status)).Inc()
+}
+
+// any method is accepted from clients, so unknown ones are counted together
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
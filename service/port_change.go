@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrPortChange           = errors.New("failed to change gateway port")
+	ErrGatewayPortActivated = errors.New("the gateway port is given by the sockets from systemd - change the socket unit instead")
+)
+
+// PortChangeStep is what changes with the gateway port, e.g. the gateways listening on it, or the config. A port change
+// prepares every step, then commits them all, or rolls back the prepared ones if any fails to prepare.
+type PortChangeStep struct {
+	// to report which step failed, e.g. `gateway`
+	Name string
+
+	// Make the change so that it can still be undone, e.g. start the new gateways but keep the old ones. A step that
+	// fails to prepare leaves nothing behind.
+	Prepare func(port string) error
+
+	// Make the change final once every step is prepared, e.g. stop the old gateways - optional.
+	Commit func(port string)
+
+	// Undo the change back to the `previous` port, if a later step failed to prepare - optional.
+	Rollback func(previous string) error
+}
+
+// PortChangeStepFailure is a step that failed, and why.
+type PortChangeStepFailure struct {
+	Step  string `json:"step"`
+	Error string `json:"error"`
+}
+
+// PortChangeError tells which step of a port change failed to prepare, and how the steps before it were rolled back.
+type PortChangeError struct {
+	Port string `json:"port"`
+	PortChangeStepFailure
+
+	// steps that were prepared, and are back at the previous port
+	RolledBack []string `json:"rolled_back"`
+
+	// steps that were prepared, and could not be rolled back - the gateway is not fully at either port
+	RollbackFailed []PortChangeStepFailure `json:"rollback_failed,omitempty"`
+
+	err error
+}
+
+func (e *PortChangeError) Error() string {
+	message := fmt.Sprintf("%s to %s: %s step failed: %s", ErrPortChange.Error(), e.Port, e.Step, e.PortChangeStepFailure.Error)
+
+	if len(e.RollbackFailed) > 0 {
+		failures := make([]string, 0, len(e.RollbackFailed))
+		for _, failure := range e.RollbackFailed {
+			failures = append(failures, failure.Step+": "+failure.Error)
+		}
+		message += " - rollback failed for " + strings.Join(failures, ", ")
+	}
+
+	return message
+}
+
+func (e *PortChangeError) Unwrap() []error {
+	return []error{ErrPortChange, e.err}
+}
+
+// prepare `steps` in order, then commit them, or roll back those prepared in reverse order if one fails
+func changePort(steps []PortChangeStep, previous, port string) error {
+	prepared := make([]PortChangeStep, 0, len(steps))
+
+	for _, step := range steps {
+		if err := step.Prepare(port); err != nil {
+			return rollbackPortChange(prepared, previous, &PortChangeError{
+				Port:                  port,
+				PortChangeStepFailure: PortChangeStepFailure{Step: step.Name, Error: err.Error()},
+				RolledBack:            make([]string, 0),
+				err:                   err,
+			})
+		}
+
+		prepared = append(prepared, step)
+	}
+
+	for _, step := range prepared {
+		if step.Commit != nil {
+			step.Commit(port)
+		}
+	}
+
+	return nil
+}
+
+func rollbackPortChange(prepared []PortChangeStep, previous string, failure *PortChangeError) error {
+	for i := len(prepared) - 1; i >= 0; i-- {
+		step := prepared[i]
+
+		if step.Rollback == nil {
+			failure.RollbackFailed = append(failure.RollbackFailed, PortChangeStepFailure{Step: step.Name, Error: "cannot be rolled back"})
+			continue
+		}
+
+		if err := step.Rollback(previous); err != nil {
+			failure.RollbackFailed = append(failure.RollbackFailed, PortChangeStepFailure{Step: step.Name, Error: err.Error()})
+			continue
+		}
+
+		failure.RolledBack = append(failure.RolledBack, step.Name)
+	}
+
+	return failure
+}
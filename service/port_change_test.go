@@ -0,0 +1,91 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSetGatewayPortCommit(t *testing.T) {
+	state := NewState()
+	assert.NilError(t, state.SetGatewayPort("80"))
+
+	var calls []string
+	for _, name := range []string{"config", "gateway"} {
+		name := name
+		state.AddPortChangeStep(PortChangeStep{
+			Name:     name,
+			Prepare:  func(port string) error { calls = append(calls, name+" prepare "+port); return nil },
+			Commit:   func(port string) { calls = append(calls, name+" commit "+port) },
+			Rollback: func(previous string) error { calls = append(calls, name+" rollback "+previous); return nil },
+		})
+	}
+
+	assert.NilError(t, state.SetGatewayPort("8080"))
+	assert.Equal(t, state.GetGatewayPort(), "8080")
+
+	// prepared in reverse order, as before there were steps
+	assert.DeepEqual(t, calls, []string{
+		"gateway prepare 8080",
+		"config prepare 8080",
+		"gateway commit 8080",
+		"config commit 8080",
+	})
+}
+
+func TestSetGatewayPortRollback(t *testing.T) {
+	state := NewState()
+	assert.NilError(t, state.SetGatewayPort("80"))
+
+	var calls []string
+
+	state.AddPortChangeStep(PortChangeStep{
+		Name:    "config",
+		Prepare: func(port string) error { return errors.New("read-only file system") },
+	})
+
+	state.OnGatewayPortChange(func(port string) error { return nil })
+
+	state.AddPortChangeStep(PortChangeStep{
+		Name:     "gateway",
+		Prepare:  func(port string) error { calls = append(calls, "gateway prepare "+port); return nil },
+		Commit:   func(port string) { calls = append(calls, "gateway commit "+port) },
+		Rollback: func(previous string) error { calls = append(calls, "gateway rollback "+previous); return nil },
+	})
+
+	err := state.SetGatewayPort("8080")
+	assert.Assert(t, errors.Is(err, ErrPortChange))
+	assert.Equal(t, state.GetGatewayPort(), "80")
+
+	var portChangeErr *PortChangeError
+	assert.Assert(t, errors.As(err, &portChangeErr))
+	assert.Equal(t, portChangeErr.Step, "config")
+	assert.Equal(t, portChangeErr.PortChangeStepFailure.Error, "read-only file system")
+	assert.DeepEqual(t, portChangeErr.RolledBack, []string{"gateway"})
+
+	// a callback cannot be undone
+	assert.DeepEqual(t, portChangeErr.RollbackFailed, []PortChangeStepFailure{{Step: "callback 2", Error: "cannot be rolled back"}})
+
+	assert.DeepEqual(t, calls, []string{"gateway prepare 8080", "gateway rollback 80"})
+	assert.ErrorContains(t, err, "failed to change gateway port to 8080: config step failed: read-only file system")
+}
+
+func TestSetGatewayPortActivated(t *testing.T) {
+	state := NewState()
+	assert.NilError(t, state.SetGatewayPort("8080"))
+
+	prepared := false
+	state.OnGatewayPortChange(func(port string) error { prepared = true; return nil })
+
+	state.SetActivatedGatewayPort("80")
+	assert.Equal(t, state.GetGatewayPort(), "80")
+	assert.Assert(t, !prepared)
+
+	assert.NilError(t, state.SetGatewayPort("80"))
+
+	err := state.SetGatewayPort("8080")
+	assert.Assert(t, errors.Is(err, ErrGatewayPortActivated))
+	assert.Equal(t, state.GetGatewayPort(), "80")
+	assert.Assert(t, !prepared)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+
+	"github.com/IceWhaleTech/CasaOS-Common/model"
+	"github.com/google/uuid"
+)
+
+const (
+	RequestIDFormatUUID = "uuid"
+	RequestIDFormatHex  = "hex"
+
+	// longer IDs from clients are replaced
+	maxRequestIDLength = 128
+)
+
+type RequestIDOptions struct {
+	Header string
+
+	// how to generate an ID for a request without one, `uuid` or `hex`
+	Format string
+}
+
+// Returns the ID from the request header if it has a usable one, or a new one.
+func (o RequestIDOptions) RequestID(r *http.Request) string {
+	if id := r.Header.Get(o.Header); isValidRequestID(id) {
+		return id
+	}
+
+	if o.Format == RequestIDFormatHex {
+		buf := make([]byte, 16)
+		if _, err := rand.Read(buf); err == nil {
+			return hex.EncodeToString(buf)
+		}
+	}
+
+	return uuid.NewString()
+}
+
+// only what is safe to put in headers and logs as is
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':' || c == '+' || c == '/' || c == '=':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// Returns the ID of the request being served by the gateway, or "" outside of it.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ErrorResult is the JSON body of errors from the gateway itself, as opposed to errors from the targets of routes.
+type ErrorResult struct {
+	model.Result
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Write an error from the gateway itself, with the ID of the request so that it can be found in the logs.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+
+	_ = json.NewEncoder(w).Encode(ErrorResult{
+		Result:    model.Result{Success: code, Message: message},
+		RequestID: RequestIDFrom(r.Context()),
+	})
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// OwnerGateway is the identity used for routes registered by the gateway itself.
+	OwnerGateway = "gateway"
+
+	// OwnerLocal is the identity of a caller from loopback that has not otherwise identified itself. It never owns a
+	// route, since any local process could use it.
+	OwnerLocal = "local"
+)
+
+var (
+	ErrRouteConflict   = errors.New("route is owned by another service")
+	ErrRouteReserved   = errors.New("route path is reserved by the gateway")
+	ErrRouteNotFound   = errors.New("route not found")
+	ErrForceNotAllowed = errors.New("only an admin can force a change to a route owned by someone else")
+	ErrInvalidRoute    = errors.New("invalid route")
+)
+
+// GatewayCaller is the caller used when the gateway registers its own routes.
+var GatewayCaller = Caller{Identity: OwnerGateway, Admin: true}
+
+type Route struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	Owner  string `json:"owner,omitempty"`
+
+	// overrides the global security headers policy for this route
+	Headers *SecurityHeaders `json:"headers,omitempty"`
+
+	// required before a request is proxied, for apps without authentication of their own
+	Auth *RouteAuth `json:"auth,omitempty"`
+
+	// overrides the access log options for this route
+	AccessLog *RouteAccessLog `json:"access_log,omitempty"`
+
+	// overrides the slow request threshold for this route
+	SlowRequest *RouteSlowRequest `json:"slow_request,omitempty"`
+}
+
+// A copy without secrets, e.g. password hashes, for anyone listing routes.
+func (r *Route) redacted() *Route {
+	if r == nil {
+		return nil
+	}
+
+	redacted := *r
+	redacted.Auth = r.Auth.redacted()
+
+	return &redacted
+}
+
+// Caller identifies whoever is asking the management service to change the routing table.
+type Caller struct {
+	Identity string
+	Admin    bool
+
+	// for the audit log only - never used to authorize
+	ClientIP string
+}
+
+// The owner recorded for routes registered by this caller - empty if it has not identified itself, so that its routes
+// stay open to anyone, as it cannot be told apart from any other local process.
+func (c Caller) owner() string {
+	if c.Identity == OwnerLocal {
+		return ""
+	}
+	return c.Identity
+}
+
+// returns true if `path` is one of `reservedPaths`, or is under one of them (except for "/", which only reserves itself)
+func isReservedPath(path string, reservedPaths []string) bool {
+	for _, reserved := range reservedPaths {
+		if path == reserved {
+			return true
+		}
+
+		if reserved != "/" && strings.HasPrefix(path, strings.TrimSuffix(reserved, "/")+"/") {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	CACertFilename     = "ca.crt"
+	CAKeyFilename      = "ca.key"
+	ServerCertFilename = "server.crt"
+	ServerKeyFilename  = "server.key"
+
+	SelfSignedHostname = "casaos.local"
+
+	caValidity = 10 * 365 * 24 * time.Hour
+
+	// browsers reject server certificates valid for longer than this, even when issued by a CA trusted by the user.
+	serverCertificateValidity = 397 * 24 * time.Hour
+
+	// reissue the server certificate when it expires within this period
+	serverCertificateRenewBefore = 30 * 24 * time.Hour
+)
+
+// Create a local CA under `path` if there is none, and issue a server certificate from it for `casaos.local`, the
+// hostname and all LAN IPs of this machine.
+//
+// The CA is kept across restarts so that users only need to trust it once. The server certificate is reissued when it
+// is about to expire, or when it no longer covers all current IPs (e.g. a new IP from DHCP).
+func EnsureSelfSignedCertificate(path string) (CertificateFiles, error) {
+	files := CertificateFiles{
+		CertFile: filepath.Join(path, ServerCertFilename),
+		KeyFile:  filepath.Join(path, ServerKeyFilename),
+	}
+
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return files, err
+	}
+
+	caCert, caKey, err := loadCA(path)
+	if err != nil {
+		logger.Info("Creating a local certificate authority...", zap.Any("path", path), zap.Any("reason", err.Error()))
+
+		if caCert, caKey, err = createCA(path); err != nil {
+			return files, err
+		}
+	}
+
+	dnsNames, ips := selfSignedHosts()
+
+	if current, err := loadCertificate(files.CertFile); err == nil &&
+		current.CheckSignatureFrom(caCert) == nil &&
+		time.Until(current.NotAfter) > serverCertificateRenewBefore &&
+		coversHosts(current, dnsNames, ips) {
+		return files, nil
+	}
+
+	logger.Info("Issuing a server certificate from the local certificate authority...", zap.Any("dnsNames", dnsNames), zap.Any("ips", ips))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return files, err
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return files, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: SelfSignedHostname, Organization: []string{"CasaOS"}},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return files, err
+	}
+
+	if err := writeKey(files.KeyFile, key); err != nil {
+		return files, err
+	}
+
+	return files, writeCertificate(files.CertFile, der)
+}
+
+func createCA(path string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "CasaOS Local CA (" + hostname + ")", Organization: []string{"CasaOS"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKey(filepath.Join(path, CAKeyFilename), key); err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeCertificate(filepath.Join(path, CACertFilename), der); err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func loadCA(path string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := loadCertificate(filepath.Join(path, CACertFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if time.Now().After(cert.NotAfter) {
+		return nil, nil, errors.New("local certificate authority is expired")
+	}
+
+	buf, err := os.ReadFile(filepath.Join(path, CAKeyFilename))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, nil, errors.New("no PEM data found in key file of local certificate authority")
+	}
+
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	buf, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + filename)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeCertificate(filename string, der []byte) error {
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644) // #nosec G306 - certificates are public
+}
+
+func writeKey(filename string, key *ecdsa.PrivateKey) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func selfSignedHosts() ([]string, []net.IP) {
+	dnsNames := []string{SelfSignedHostname, "localhost"}
+
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname, hostname+".local")
+	}
+
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logger.Error("Failed to get IPs of this machine for the server certificate", zap.Any("error", err))
+		return dnsNames, ips
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+
+	return dnsNames, ips
+}
+
+func coversHosts(cert *x509.Certificate, dnsNames []string, ips []net.IP) bool {
+	for _, dnsName := range dnsNames {
+		if cert.VerifyHostname(dnsName) != nil {
+			return false
+		}
+	}
+
+	for _, ip := range ips {
+		if cert.VerifyHostname(ip.String()) != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A self-signed certificate for this machine that is only kept in memory, to serve TLS until a certificate is issued,
+// e.g. by ACME.
+func TemporaryCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	dnsNames, ips := selfSignedHosts()
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: SelfSignedHostname, Organization: []string{"CasaOS"}},
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverCertificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
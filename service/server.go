@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+var ErrDrainTimeout = errors.New("server did not drain in time")
+
+// how often the requests still in flight are logged while draining
+const drainReportInterval = 5 * time.Second
+
+// Server is an HTTP server that keeps track of its requests and connections, so that it can be drained before it
+// stops, including requests it no longer owns the connection of, e.g. WebSockets.
+type Server struct {
+	*http.Server
+
+	// as `TLSConfig` is set by `Serve` for HTTP/2 either way
+	tls bool
+
+	inFlight atomic.Int64
+	requests sync.WaitGroup
+
+	conns      map[*trackedConn]struct{}
+	connsMutex sync.Mutex
+}
+
+// `server.Handler` is wrapped to count requests in flight.
+func NewServer(server *http.Server) *Server {
+	s := &Server{
+		Server: server,
+		tls:    server.TLSConfig != nil,
+		conns:  make(map[*trackedConn]struct{}),
+	}
+
+	handler := server.Handler
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		s.inFlight.Add(1)
+		defer func() {
+			s.inFlight.Add(-1)
+			s.requests.Done()
+		}()
+
+		handler.ServeHTTP(w, r)
+	})
+
+	return s
+}
+
+// Serve on `listener`, over TLS if the server has a `TLSConfig`.
+func (s *Server) Serve(listener net.Listener) error {
+	listener = &trackedListener{Listener: listener, server: s}
+
+	if s.tls {
+		return s.Server.ServeTLS(listener, "", "")
+	}
+	return s.Server.Serve(listener)
+}
+
+// Whether the server serves HTTPS.
+func (s *Server) TLS() bool {
+	return s.tls
+}
+
+// Requests being served, including upgraded ones.
+func (s *Server) InFlight() int64 {
+	return s.inFlight.Load()
+}
+
+// Stop accepting connections, and wait up to `timeout` for the requests in flight to complete, without keep-alive so
+// that clients reconnect elsewhere. Connections still open at the deadline are closed, returning `ErrDrainTimeout`.
+func (s *Server) Drain(timeout time.Duration) error {
+	start := time.Now()
+	address := s.Addr
+
+	s.SetKeepAlivesEnabled(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	logger.Info("Draining server", zap.String("address", address), zap.Int64("in_flight", s.InFlight()), zap.Duration("timeout", timeout))
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// `Shutdown` does not wait for connections that were hijacked, so it is done when their requests are
+	var drained chan struct{}
+
+	report := time.NewTicker(drainReportInterval)
+	defer report.Stop()
+
+	for {
+		select {
+		case err := <-shutdown:
+			if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+				return err
+			}
+
+			// no new request can start once every connection the server owns is closed
+			drained = make(chan struct{})
+			go func() {
+				s.requests.Wait()
+				close(drained)
+			}()
+
+		case <-drained:
+			logger.Info("Server is drained", zap.String("address", address), zap.Duration("duration", time.Since(start)))
+			return nil
+
+		case <-report.C:
+			logger.Info("Draining server...", zap.String("address", address), zap.Int64("in_flight", s.InFlight()))
+
+		case <-ctx.Done():
+			inFlight := s.InFlight()
+			conns := s.closeConns()
+
+			logger.Info("Server did not drain in time - connections are closed", zap.String("address", address), zap.Int64("in_flight", inFlight), zap.Int("connections", conns))
+			return fmt.Errorf("%w: %d requests in flight after %s", ErrDrainTimeout, inFlight, timeout)
+		}
+	}
+}
+
+// closes every connection, owned by the server or not, and returns how many there were
+func (s *Server) closeConns() int {
+	s.connsMutex.Lock()
+	conns := make([]*trackedConn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.connsMutex.Unlock()
+
+	_ = s.Close()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+
+	return len(conns)
+}
+
+type trackedListener struct {
+	net.Listener
+
+	server *Server
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := &trackedConn{Conn: conn, server: l.server}
+
+	l.server.connsMutex.Lock()
+	l.server.conns[tracked] = struct{}{}
+	l.server.connsMutex.Unlock()
+
+	return tracked, nil
+}
+
+// trackedConn is forgotten by its server when closed, by the server or by whoever hijacked it.
+type trackedConn struct {
+	net.Conn
+
+	server *Server
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.server.connsMutex.Lock()
+		delete(c.server.conns, c)
+		c.server.connsMutex.Unlock()
+	})
+
+	return c.Conn.Close()
+}
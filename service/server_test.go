@@ -0,0 +1,124 @@
+package service
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestServerDrain(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	server := NewServer(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			_, _ = w.Write([]byte("done"))
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go func() { _ = server.Serve(listener) }()
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			close(responses)
+			return
+		}
+		responses <- response
+	}()
+
+	<-started
+	assert.Equal(t, int64(1), server.InFlight())
+
+	drained := make(chan error, 1)
+	go func() { drained <- server.Drain(5 * time.Second) }()
+
+	// no new connections while draining
+	assert.NilError(t, waitFor(func() bool {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}))
+
+	close(release)
+
+	response, ok := <-responses
+	assert.Assert(t, ok)
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	assert.NilError(t, err)
+	assert.Equal(t, "done", string(body))
+	assert.Assert(t, response.Close) // without keep-alive
+
+	assert.NilError(t, <-drained)
+	assert.Equal(t, int64(0), server.InFlight())
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	// like a WebSocket, on a connection the server no longer owns
+	server := NewServer(&http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, buffer, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			_, _ = buffer.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n")
+			_ = buffer.Flush()
+			_, _ = io.Copy(io.Discard, conn)
+		}),
+		ReadHeaderTimeout: 5 * time.Second,
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	go func() { _ = server.Serve(listener) }()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: test\r\n\r\n"))
+	assert.NilError(t, err)
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+
+	err = server.Drain(200 * time.Millisecond)
+	assert.Assert(t, errors.Is(err, ErrDrainTimeout), err)
+
+	// closed by the server
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = reader.ReadByte()
+	assert.Assert(t, errors.Is(err, io.EOF), err)
+
+	assert.NilError(t, waitFor(func() bool { return server.InFlight() == 0 }))
+}
+
+func waitFor(condition func() bool) error {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return errors.New("condition not met in time")
+}
@@ -0,0 +1,242 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// slow requests kept for each route, with their timings
+const slowRequestsKept = 10
+
+// RouteSlowRequest overrides the slow request threshold for a route.
+type RouteSlowRequest struct {
+	Disabled bool `json:"disabled,omitempty"`
+
+	// seconds the target can take before a request is slow - 0 for the global threshold
+	Threshold float64 `json:"threshold,omitempty"`
+}
+
+func (s *RouteSlowRequest) validate() error {
+	if s != nil && s.Threshold < 0 {
+		return fmt.Errorf("%w: slow request threshold must not be negative", ErrInvalidRoute)
+	}
+	return nil
+}
+
+// UpstreamTiming is where the time of a request to the target went, in seconds.
+type UpstreamTiming struct {
+	DNS  float64 `json:"dns"`
+	Dial float64 `json:"dial"`
+	TLS  float64 `json:"tls"`
+
+	// from the request being sent to the first byte of the response
+	TimeToFirstByte float64 `json:"ttfb"`
+
+	// from the first byte to the end of the response
+	Transfer float64 `json:"transfer"`
+
+	Total float64 `json:"total"`
+
+	// no DNS, dial or TLS on a connection that is reused
+	Reused bool `json:"reused"`
+}
+
+// The time until the target started to respond, which is what makes a request slow - not how long the response takes
+// after, e.g. a large download, or a stream.
+func (t UpstreamTiming) UntilResponse() float64 {
+	return t.Total - t.Transfer
+}
+
+type SlowRequest struct {
+	Time      time.Time      `json:"time"`
+	RequestID string         `json:"request_id"`
+	Method    string         `json:"method"`
+	URI       string         `json:"uri"`
+	Status    int            `json:"status"`
+	Timing    UpstreamTiming `json:"timing"`
+}
+
+type RouteSlowRequests struct {
+	Path string `json:"path"`
+
+	// seconds
+	Threshold float64 `json:"threshold"`
+
+	// since the gateway started
+	Count uint64 `json:"count"`
+
+	// the most recent, newest first
+	Recent []SlowRequest `json:"recent"`
+}
+
+// UpstreamTimer records the phases of a request to the target of a route, through the transport of its proxy.
+type UpstreamTimer struct {
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	reused       bool
+
+	// the transport calls back from its own goroutines
+	mutex sync.Mutex
+}
+
+type upstreamTimerKey struct{}
+
+func WithUpstreamTimer(ctx context.Context) (context.Context, *UpstreamTimer) {
+	timer := &UpstreamTimer{}
+	return context.WithValue(ctx, upstreamTimerKey{}, timer), timer
+}
+
+func upstreamTimerFrom(ctx context.Context) *UpstreamTimer {
+	timer, _ := ctx.Value(upstreamTimerKey{}).(*UpstreamTimer)
+	return timer
+}
+
+// Returns the timing of the request to the target, taken to be over at `end`, or false if it was not sent.
+func (t *UpstreamTimer) Timing(end time.Time) (UpstreamTiming, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.start.IsZero() {
+		return UpstreamTiming{}, false
+	}
+
+	timing := UpstreamTiming{
+		DNS:    between(t.dnsStart, t.dnsDone),
+		Dial:   between(t.connectStart, t.connectDone),
+		TLS:    between(t.tlsStart, t.tlsDone),
+		Total:  between(t.start, end),
+		Reused: t.reused,
+	}
+
+	if !t.firstByte.IsZero() {
+		timing.TimeToFirstByte = between(t.wroteRequest, t.firstByte)
+		timing.Transfer = between(t.firstByte, end)
+	}
+
+	return timing, true
+}
+
+func between(start, end time.Time) float64 {
+	if start.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
+func (t *UpstreamTimer) clientTrace() *httptrace.ClientTrace {
+	now := func(field *time.Time) {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+
+		// only the first, e.g. of several addresses dialled
+		if field.IsZero() {
+			*field = time.Now()
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { now(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { now(&t.dnsDone) },
+		ConnectStart:      func(string, string) { now(&t.connectStart) },
+		ConnectDone:       func(string, string, error) { now(&t.connectDone) },
+		TLSHandshakeStart: func() { now(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { now(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mutex.Lock()
+			defer t.mutex.Unlock()
+			t.reused = info.Reused
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { now(&t.wroteRequest) },
+		GotFirstResponseByte: func() { now(&t.firstByte) },
+	}
+}
+
+// timedTransport traces requests to targets that have an `UpstreamTimer` in their context.
+type timedTransport struct {
+	http.RoundTripper
+}
+
+func (t *timedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	timer := upstreamTimerFrom(r.Context())
+	if timer == nil {
+		return t.RoundTripper.RoundTrip(r)
+	}
+
+	timer.mutex.Lock()
+	if timer.start.IsZero() {
+		timer.start = time.Now()
+	}
+	timer.mutex.Unlock()
+
+	return t.RoundTripper.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), timer.clientTrace())))
+}
+
+// slowRequests counts the slow requests of each route, keeping the most recent.
+type slowRequests struct {
+	routes map[string]*RouteSlowRequests
+	mutex  sync.Mutex
+}
+
+func newSlowRequests() *slowRequests {
+	return &slowRequests{routes: make(map[string]*RouteSlowRequests)}
+}
+
+func (s *slowRequests) record(path string, threshold time.Duration, request SlowRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	route, ok := s.routes[path]
+	if !ok {
+		route = &RouteSlowRequests{Path: path}
+		s.routes[path] = route
+	}
+
+	route.Threshold = threshold.Seconds()
+	route.Count++
+	route.Recent = append([]SlowRequest{request}, route.Recent...)
+	if len(route.Recent) > slowRequestsKept {
+		route.Recent = route.Recent[:slowRequestsKept]
+	}
+}
+
+func (s *slowRequests) delete(path string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.routes, path)
+}
+
+// the routes with the most slow requests first
+func (s *slowRequests) get() []RouteSlowRequests {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	routes := make([]RouteSlowRequests, 0, len(s.routes))
+	for _, route := range s.routes {
+		copied := *route
+		copied.Recent = append([]SlowRequest(nil), route.Recent...)
+		routes = append(routes, copied)
+	}
+
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Count != routes[j].Count {
+			return routes[i].Count > routes[j].Count
+		}
+		return routes[i].Path < routes[j].Path
+	})
+
+	return routes
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestSlowRequests(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-slow-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+	assert.NilError(t, state.SetSlowRequestThreshold(3*time.Second))
+
+	management := NewManagementService(state)
+	caller := Caller{Identity: "app"}
+
+	err := management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080", SlowRequest: &RouteSlowRequest{Threshold: -1}}, caller, false)
+	assert.Assert(t, errors.Is(err, ErrInvalidRoute))
+
+	assert.Equal(t, 3*time.Second, management.SlowRequestThreshold(&Route{Path: "/app"}))
+	assert.Equal(t, 500*time.Millisecond, management.SlowRequestThreshold(&Route{Path: "/app", SlowRequest: &RouteSlowRequest{Threshold: 0.5}}))
+	assert.Equal(t, time.Duration(0), management.SlowRequestThreshold(&Route{Path: "/app", SlowRequest: &RouteSlowRequest{Disabled: true, Threshold: 0.5}}))
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080"}, caller, false))
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/other", Target: "http://localhost:8081"}, caller, false))
+
+	management.ObserveSlowRequest("/other", 3*time.Second, SlowRequest{RequestID: "other"})
+	for i := 0; i < slowRequestsKept+2; i++ {
+		management.ObserveSlowRequest("/app", 3*time.Second, SlowRequest{RequestID: string(rune('a' + i))})
+	}
+
+	routes := management.GetSlowRequests()
+	assert.Equal(t, 2, len(routes))
+	assert.Equal(t, "/app", routes[0].Path)
+	assert.Equal(t, uint64(slowRequestsKept+2), routes[0].Count)
+	assert.Equal(t, 3.0, routes[0].Threshold)
+	assert.Equal(t, slowRequestsKept, len(routes[0].Recent))
+	assert.Equal(t, string(rune('a'+slowRequestsKept+1)), routes[0].Recent[0].RequestID) // newest first
+	assert.Equal(t, "/other", routes[1].Path)
+
+	// gone with the route
+	assert.NilError(t, management.DeleteRoute("/app", caller, false))
+	assert.Equal(t, 1, len(management.GetSlowRequests()))
+}
+
+func TestUpstreamTimer(t *testing.T) {
+	_, timer := WithUpstreamTimer(context.Background())
+
+	// never sent to the target
+	_, ok := timer.Timing(time.Now())
+	assert.Assert(t, !ok)
+
+	start := time.Now()
+	timer.start = start
+	timer.wroteRequest = start.Add(10 * time.Millisecond)
+	timer.firstByte = start.Add(110 * time.Millisecond)
+
+	timing, ok := timer.Timing(start.Add(150 * time.Millisecond))
+	assert.Assert(t, ok)
+	assert.Equal(t, 0.15, timing.Total)
+	assert.Equal(t, 0.1, timing.TimeToFirstByte)
+	assert.Equal(t, 0.04, timing.Transfer)
+	assert.Equal(t, 0.0, timing.DNS)
+}
@@ -1,51 +1,192 @@
 package service
 
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrWritesSuspended = errors.New("the gateway is being upgraded - try again shortly")
+
 type State struct {
 	gatewayPort         string
-	onGatewayPortChange []func(string) error
+	activatedPort       bool
+	onGatewayPortChange []PortChangeStep
+	portChangeMutex     sync.Mutex
+	listenAddresses     []ListenAddress
+
+	// how long a gateway that is stopped has to finish its requests
+	drainTimeout time.Duration
+
+	runtimePath   string
+	wwwPath       string
+	auditLogPath  string
+	reservedPaths []string
+	tlsOptions    TLSOptions
+	acmeOptions   ACMEOptions
+
+	securityHeaders   SecurityHeaders
+	managementOptions ManagementOptions
+	accessLogOptions  AccessLogOptions
+	requestIDOptions  RequestIDOptions
+	tracingOptions    TracingOptions
+
+	// 0 for no slow requests, unless a route has its own threshold
+	slowRequestThreshold time.Duration
+
+	// options below can be reloaded from gateway.ini while running
+	corsOptions CORSOptions
+	mutex       sync.RWMutex
 
-	runtimePath string
-	wwwPath     string
+	// held for reading by each change to the routes or the port, see `SuspendWrites`
+	writesMutex     sync.RWMutex
+	writesSuspended bool
 }
 
 func NewState() *State {
 	return &State{
 		gatewayPort:         "",
-		onGatewayPortChange: make([]func(string) error, 0),
+		onGatewayPortChange: make([]PortChangeStep, 0),
+		listenAddresses:     []ListenAddress{{}}, // every interface
+		drainTimeout:        30 * time.Second,
 
-		runtimePath: "",
-		wwwPath:     "",
+		runtimePath:   "",
+		wwwPath:       "",
+		reservedPaths: make([]string, 0),
+
+		// as before there were options for it
+		managementOptions: ManagementOptions{LoopbackBypass: true},
+		requestIDOptions:  RequestIDOptions{Header: "X-Request-ID", Format: RequestIDFormatUUID},
 	}
 }
 
-func (c *State) SetGatewayPort(port string) (err error) {
-	defer func() {
-		if err == nil {
-			c.gatewayPort = port
+// Change the gateway port with every step added by `OnGatewayPortChange` or `AddPortChangeStep`, or none of them - a
+// `*PortChangeError` tells which step failed.
+func (c *State) SetGatewayPort(port string) error {
+	c.portChangeMutex.Lock()
+	defer c.portChangeMutex.Unlock()
+
+	if c.activatedPort {
+		if port == c.gatewayPort {
+			return nil
 		}
-	}()
-	return c.notifyOnGatewayPortChange(port)
+		return fmt.Errorf("%w: cannot change it from %s to %s", ErrGatewayPortActivated, c.gatewayPort, port)
+	}
+
+	steps := make([]PortChangeStep, 0, len(c.onGatewayPortChange))
+	for i := len(c.onGatewayPortChange) - 1; i >= 0; i-- {
+		steps = append(steps, c.onGatewayPortChange[i])
+	}
+
+	if err := changePort(steps, c.gatewayPort, port); err != nil {
+		return err
+	}
+
+	c.setGatewayPort(port)
+	return nil
+}
+
+// Take the gateway port from a socket passed by systemd, which the gateway cannot move to another port - so no step
+// runs (e.g. nothing is written to the config), and any change after this is rejected.
+func (c *State) SetActivatedGatewayPort(port string) {
+	c.portChangeMutex.Lock()
+	defer c.portChangeMutex.Unlock()
+
+	c.setGatewayPort(port)
+	c.activatedPort = true
+}
+
+// only changed with `portChangeMutex` held, which is enough to read it then - the lock is for anyone else, e.g. the
+// watchdog
+func (c *State) setGatewayPort(port string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.gatewayPort = port
 }
 
 func (c *State) GetGatewayPort() string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
 	return c.gatewayPort
 }
 
-// Add func `f` to the stack. The stack of funcs will be called, in reverse order, when there is request to change the port.
+// Add func `f` to the stack, as a step that cannot be rolled back. See `AddPortChangeStep`.
 func (c *State) OnGatewayPortChange(f func(string) error) {
-	c.onGatewayPortChange = append(c.onGatewayPortChange, f)
+	c.AddPortChangeStep(PortChangeStep{Name: fmt.Sprintf("callback %d", len(c.onGatewayPortChange)+1), Prepare: f})
 }
 
-func (c *State) notifyOnGatewayPortChange(port string) error {
-	for i := len(c.onGatewayPortChange) - 1; i >= 0; i-- {
-		if err := c.onGatewayPortChange[i](port); err != nil {
-			return err
+// Add `step` to the stack. The steps are prepared, in reverse order, when there is request to change the port.
+func (c *State) AddPortChangeStep(step PortChangeStep) {
+	c.onGatewayPortChange = append(c.onGatewayPortChange, step)
+}
+
+// Refuse changes to the routes and the port with `ErrWritesSuspended`, e.g. while a new process is taking over, which
+// has already read them. It waits for the changes in progress to finish.
+func (c *State) SuspendWrites() {
+	c.writesMutex.Lock()
+	defer c.writesMutex.Unlock()
+
+	c.writesSuspended = true
+}
+
+// Accept changes again, e.g. when the new process failed to take over.
+func (c *State) ResumeWrites() {
+	c.writesMutex.Lock()
+	defer c.writesMutex.Unlock()
+
+	c.writesSuspended = false
+}
+
+// Start a change to the routes or the port, unless writes are suspended. The returned func ends it.
+func (c *State) beginWrite() (func(), error) {
+	c.writesMutex.RLock()
+
+	if c.writesSuspended {
+		c.writesMutex.RUnlock()
+		return nil, ErrWritesSuspended
+	}
+
+	return c.writesMutex.RUnlock, nil
+}
+
+func (c *State) SetListenAddresses(addresses []ListenAddress) error {
+	c.listenAddresses = addresses
+	return nil
+}
+
+func (c *State) GetListenAddresses() []ListenAddress {
+	return c.listenAddresses
+}
+
+// The ports the gateway listens on, the gateway port first.
+func (c *State) GetGatewayPorts() []string {
+	gatewayPort := c.GetGatewayPort()
+
+	ports := []string{gatewayPort}
+	seen := map[string]bool{gatewayPort: true}
+
+	for _, address := range c.listenAddresses {
+		if !address.FollowsGatewayPort() && !seen[address.Port] {
+			seen[address.Port] = true
+			ports = append(ports, address.Port)
 		}
 	}
 
+	return ports
+}
+
+func (c *State) SetDrainTimeout(timeout time.Duration) error {
+	c.drainTimeout = timeout
 	return nil
 }
 
+func (c *State) GetDrainTimeout() time.Duration {
+	return c.drainTimeout
+}
+
 func (c *State) SetRuntimePath(path string) error {
 	c.runtimePath = path
 	return nil
@@ -55,6 +196,51 @@ func (c *State) GetRuntimePath() string {
 	return c.runtimePath
 }
 
+func (c *State) SetAccessLogOptions(options AccessLogOptions) error {
+	c.accessLogOptions = options
+	return nil
+}
+
+func (c *State) GetAccessLogOptions() AccessLogOptions {
+	return c.accessLogOptions
+}
+
+func (c *State) SetRequestIDOptions(options RequestIDOptions) error {
+	c.requestIDOptions = options
+	return nil
+}
+
+func (c *State) GetRequestIDOptions() RequestIDOptions {
+	return c.requestIDOptions
+}
+
+func (c *State) SetTracingOptions(options TracingOptions) error {
+	c.tracingOptions = options
+	return nil
+}
+
+func (c *State) GetTracingOptions() TracingOptions {
+	return c.tracingOptions
+}
+
+func (c *State) SetSlowRequestThreshold(threshold time.Duration) error {
+	c.slowRequestThreshold = threshold
+	return nil
+}
+
+func (c *State) GetSlowRequestThreshold() time.Duration {
+	return c.slowRequestThreshold
+}
+
+func (c *State) SetAuditLogPath(path string) error {
+	c.auditLogPath = path
+	return nil
+}
+
+func (c *State) GetAuditLogPath() string {
+	return c.auditLogPath
+}
+
 func (c *State) SetWWWPath(path string) error {
 	c.wwwPath = path
 	return nil
@@ -63,3 +249,69 @@ func (c *State) SetWWWPath(path string) error {
 func (c *State) GetWWWPath() string {
 	return c.wwwPath
 }
+
+func (c *State) SetReservedPaths(paths []string) error {
+	c.reservedPaths = paths
+	return nil
+}
+
+// Paths that only the gateway itself (or an admin, by force) can register routes at.
+func (c *State) GetReservedPaths() []string {
+	return c.reservedPaths
+}
+
+func (c *State) SetTLSOptions(options TLSOptions) error {
+	c.tlsOptions = options
+	return nil
+}
+
+func (c *State) GetTLSOptions() TLSOptions {
+	return c.tlsOptions
+}
+
+func (c *State) SetACMEOptions(options ACMEOptions) error {
+	c.acmeOptions = options
+	return nil
+}
+
+func (c *State) GetACMEOptions() ACMEOptions {
+	return c.acmeOptions
+}
+
+func (c *State) SetSecurityHeaders(headers SecurityHeaders) error {
+	c.securityHeaders = headers
+	return nil
+}
+
+// The global policy for security headers, which routes can override.
+func (c *State) GetSecurityHeaders() SecurityHeaders {
+	return c.securityHeaders
+}
+
+func (c *State) SetManagementOptions(options ManagementOptions) error {
+	c.managementOptions = options
+	return nil
+}
+
+func (c *State) GetManagementOptions() ManagementOptions {
+	return c.managementOptions
+}
+
+func (c *State) SetCORSOptions(options CORSOptions) error {
+	if err := options.validate(); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.corsOptions = options
+	return nil
+}
+
+func (c *State) GetCORSOptions() CORSOptions {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.corsOptions
+}
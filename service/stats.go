@@ -0,0 +1,208 @@
+package service
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Stats of a route cover the last `RouteStatsWindow`, in slots that expire one at a time.
+const (
+	RouteStatsWindow = 5 * time.Minute
+
+	routeStatsSlotDuration = 10 * time.Second
+	routeStatsSlots        = int(RouteStatsWindow / routeStatsSlotDuration)
+
+	// one more than there are bounds, for anything slower
+	routeStatsLatencyBuckets = 65
+)
+
+// upper bounds of the latency buckets, growing by 25% from 100µs to about 2 minutes
+var routeStatsLatencyBounds = func() []float64 {
+	bounds := make([]float64, routeStatsLatencyBuckets-1)
+	for i := range bounds {
+		bounds[i] = 0.0001 * math.Pow(1.25, float64(i))
+	}
+	return bounds
+}()
+
+type RouteStats struct {
+	// seconds covered by the stats, up to `RouteStatsWindow` - less for a route that is newer, but at least one slot
+	Window float64 `json:"window"`
+
+	Requests  uint64 `json:"requests"`
+	Status2xx uint64 `json:"status_2xx"`
+	Status4xx uint64 `json:"status_4xx"`
+	Status5xx uint64 `json:"status_5xx"`
+	BytesIn   uint64 `json:"bytes_in"`
+	BytesOut  uint64 `json:"bytes_out"`
+
+	// per second
+	RequestRate float64 `json:"request_rate"`
+
+	// fraction of requests with a 5xx status
+	ErrorRate float64 `json:"error_rate"`
+
+	Latency LatencyPercentiles `json:"latency"`
+}
+
+// seconds, estimated from buckets with bounds 25% apart
+type LatencyPercentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+}
+
+// RouteWithStats is a route as listed with `?stats=true`.
+type RouteWithStats struct {
+	*Route
+	Stats *RouteStats `json:"stats"`
+}
+
+type routeStatsSlot struct {
+	// which slot since the epoch it is, to tell if it has expired
+	number int64
+
+	requests  uint64
+	status2xx uint64
+	status4xx uint64
+	status5xx uint64
+	bytesIn   uint64
+	bytesOut  uint64
+	latencies [routeStatsLatencyBuckets]uint64
+}
+
+// routeStats are the rolling counters of a route, in a ring of slots.
+type routeStats struct {
+	created time.Time
+	slots   [routeStatsSlots]routeStatsSlot
+	mutex   sync.Mutex
+}
+
+func newRouteStats(now time.Time) *routeStats {
+	return &routeStats{created: now}
+}
+
+func (s *routeStats) observe(now time.Time, status int, bytesIn, bytesOut int64, latency time.Duration) {
+	number := now.UnixNano() / int64(routeStatsSlotDuration)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	slot := &s.slots[number%int64(routeStatsSlots)]
+	if slot.number != number {
+		*slot = routeStatsSlot{number: number}
+	}
+
+	slot.requests++
+
+	switch {
+	case status >= http.StatusInternalServerError:
+		slot.status5xx++
+	case status >= http.StatusBadRequest:
+		slot.status4xx++
+	case status >= http.StatusOK && status < http.StatusMultipleChoices:
+		slot.status2xx++
+	}
+
+	if bytesIn > 0 {
+		slot.bytesIn += uint64(bytesIn)
+	}
+	if bytesOut > 0 {
+		slot.bytesOut += uint64(bytesOut)
+	}
+
+	slot.latencies[latencyBucket(latency.Seconds())]++
+}
+
+func (s *routeStats) get(now time.Time) *RouteStats {
+	number := now.UnixNano() / int64(routeStatsSlotDuration)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := &RouteStats{}
+
+	var latencies [routeStatsLatencyBuckets]uint64
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if slot.number <= number-int64(routeStatsSlots) || slot.number > number {
+			continue
+		}
+
+		stats.Requests += slot.requests
+		stats.Status2xx += slot.status2xx
+		stats.Status4xx += slot.status4xx
+		stats.Status5xx += slot.status5xx
+		stats.BytesIn += slot.bytesIn
+		stats.BytesOut += slot.bytesOut
+
+		for j, count := range slot.latencies {
+			latencies[j] += count
+		}
+	}
+
+	window := now.Sub(s.created)
+	switch {
+	case window > RouteStatsWindow || window <= 0:
+		window = RouteStatsWindow
+	case window < routeStatsSlotDuration:
+		// otherwise a single request right after the first one would be a rate of thousands per second
+		window = routeStatsSlotDuration
+	}
+	stats.Window = window.Seconds()
+
+	stats.RequestRate = float64(stats.Requests) / stats.Window
+	if stats.Requests > 0 {
+		stats.ErrorRate = float64(stats.Status5xx) / float64(stats.Requests)
+	}
+
+	stats.Latency = LatencyPercentiles{
+		P50: latencyPercentile(latencies[:], stats.Requests, 0.50),
+		P95: latencyPercentile(latencies[:], stats.Requests, 0.95),
+		P99: latencyPercentile(latencies[:], stats.Requests, 0.99),
+	}
+
+	return stats
+}
+
+func latencyBucket(seconds float64) int {
+	for i, bound := range routeStatsLatencyBounds {
+		if seconds <= bound {
+			return i
+		}
+	}
+	return len(routeStatsLatencyBounds)
+}
+
+// interpolated within the bucket the percentile falls in
+func latencyPercentile(latencies []uint64, total uint64, percentile float64) float64 {
+	if total == 0 {
+		return 0
+	}
+
+	rank := percentile * float64(total)
+
+	var seen uint64
+	for i, count := range latencies {
+		if count == 0 || float64(seen+count) < rank {
+			seen += count
+			continue
+		}
+
+		if i == len(routeStatsLatencyBounds) {
+			return routeStatsLatencyBounds[i-1]
+		}
+
+		lower := 0.0
+		if i > 0 {
+			lower = routeStatsLatencyBounds[i-1]
+		}
+		upper := routeStatsLatencyBounds[i]
+
+		return lower + (upper-lower)*(rank-float64(seen))/float64(count)
+	}
+
+	return routeStatsLatencyBounds[len(routeStatsLatencyBounds)-1]
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRouteStats(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	stats := newRouteStats(start)
+
+	// 100 requests, taking 1ms to 100ms
+	for i := 1; i <= 100; i++ {
+		status := 200
+		switch {
+		case i > 98:
+			status = 502
+		case i > 90:
+			status = 404
+		}
+
+		stats.observe(start.Add(time.Duration(i)*time.Second), status, 10, 1000, time.Duration(i)*time.Millisecond)
+	}
+
+	now := start.Add(100 * time.Second)
+	result := stats.get(now)
+
+	assert.Equal(t, uint64(100), result.Requests)
+	assert.Equal(t, uint64(90), result.Status2xx)
+	assert.Equal(t, uint64(8), result.Status4xx)
+	assert.Equal(t, uint64(2), result.Status5xx)
+	assert.Equal(t, uint64(1000), result.BytesIn)
+	assert.Equal(t, uint64(100000), result.BytesOut)
+	assert.Equal(t, 100.0, result.Window)
+	assert.Equal(t, 1.0, result.RequestRate)
+	assert.Equal(t, 0.02, result.ErrorRate)
+
+	// within the 25% of the buckets
+	for expected, actual := range map[float64]float64{0.050: result.Latency.P50, 0.095: result.Latency.P95, 0.099: result.Latency.P99} {
+		assert.Assert(t, actual > expected*0.75 && actual < expected*1.25, "expected about %v, got %v", expected, actual)
+	}
+
+	// the oldest requests expire as the window rolls on, 10 seconds at a time - here all before the 50th second
+	result = stats.get(start.Add(RouteStatsWindow + 45*time.Second))
+	assert.Equal(t, uint64(51), result.Requests)
+	assert.Equal(t, RouteStatsWindow.Seconds(), result.Window)
+
+	result = stats.get(start.Add(RouteStatsWindow + 110*time.Second))
+	assert.Equal(t, uint64(0), result.Requests)
+	assert.Equal(t, 0.0, result.Latency.P99)
+}
+
+func TestRouteStatsFirstRequest(t *testing.T) {
+	start := time.Date(2024, 1, 2, 15, 4, 0, 0, time.UTC)
+	stats := newRouteStats(start)
+	stats.observe(start, 200, 10, 1000, time.Millisecond)
+
+	// a few milliseconds after, the rate is still over the first slot
+	result := stats.get(start.Add(5 * time.Millisecond))
+	assert.Equal(t, uint64(1), result.Requests)
+	assert.Equal(t, routeStatsSlotDuration.Seconds(), result.Window)
+	assert.Equal(t, 0.1, result.RequestRate)
+
+	result = stats.get(start.Add(20 * time.Second))
+	assert.Equal(t, 20.0, result.Window)
+	assert.Equal(t, 0.05, result.RequestRate)
+}
+
+func TestManagementRouteStats(t *testing.T) {
+	tmpdir, _ := os.MkdirTemp("", "casaos-gateway-stats-test")
+
+	defer func() {
+		os.RemoveAll(tmpdir)
+	}()
+
+	state := NewState()
+	assert.NilError(t, state.SetRuntimePath(tmpdir))
+
+	management := NewManagementService(state)
+	caller := Caller{Identity: "app"}
+
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080"}, caller, false))
+
+	_, err := management.GetRouteStats("/unknown")
+	assert.Assert(t, errors.Is(err, ErrRouteNotFound))
+
+	// before any request
+	stats, err := management.GetRouteStats("/app")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(0), stats.Requests)
+
+	management.ObserveRouteRequest("/app", 200, 0, 512, time.Millisecond)
+
+	routes := management.GetRoutesWithStats()
+	assert.Equal(t, 1, len(routes))
+	assert.Equal(t, "/app", routes[0].Path)
+	assert.Equal(t, uint64(1), routes[0].Stats.Requests)
+	assert.Equal(t, uint64(512), routes[0].Stats.BytesOut)
+	assert.Assert(t, management.RequestRate() > 0)
+
+	// gone with the route
+	assert.NilError(t, management.DeleteRoute("/app", caller, false))
+	assert.NilError(t, management.CreateRoute(&Route{Path: "/app", Target: "http://localhost:8080"}, caller, false))
+
+	stats, err = management.GetRouteStats("/app")
+	assert.NilError(t, err)
+	assert.Equal(t, uint64(0), stats.Requests)
+	assert.Equal(t, 0.0, management.RequestRate())
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const TracingServiceName = "casaos-gateway"
+
+type TracingOptions struct {
+	Enabled bool
+
+	// OTLP over HTTP, e.g. `http://localhost:4318` for a local collector
+	Endpoint string
+
+	// fraction of new traces to sample, from 0 to 1. Requests in a trace sampled upstream are always sampled.
+	SampleRate float64
+}
+
+// Tracing holds what the servers need to start spans and propagate them with W3C `traceparent`/`tracestate`. When
+// tracing is disabled, spans are not recorded, but the trace context from clients is still passed to targets.
+type Tracing struct {
+	provider   trace.TracerProvider
+	propagator propagation.TextMapPropagator
+	shutdown   func(context.Context) error
+}
+
+func NewTracing(state *State) (*Tracing, error) {
+	options := state.GetTracingOptions()
+
+	if !options.Enabled {
+		return NewTracingWithProvider(noop.NewTracerProvider()), nil
+	}
+
+	exporterOptions, err := otlpOptionsFrom(options.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// the exporter connects lazily, so a collector that is not up yet does not stop the gateway
+	exporter, err := otlptracehttp.New(context.Background(), exporterOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRate))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(TracingServiceName))),
+	)
+
+	return NewTracingWithProvider(provider), nil
+}
+
+// Tracing with the spans from `provider`, e.g. to record them in tests.
+func NewTracingWithProvider(provider trace.TracerProvider) *Tracing {
+	tracing := &Tracing{
+		provider:   provider,
+		propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+		shutdown:   func(context.Context) error { return nil },
+	}
+
+	if p, ok := provider.(interface{ Shutdown(context.Context) error }); ok {
+		tracing.shutdown = p.Shutdown
+	}
+
+	return tracing
+}
+
+func (t *Tracing) TracerProvider() trace.TracerProvider {
+	return t.provider
+}
+
+func (t *Tracing) Propagator() propagation.TextMapPropagator {
+	return t.propagator
+}
+
+func (t *Tracing) Tracer() trace.Tracer {
+	return t.provider.Tracer(TracingServiceName)
+}
+
+// Export the spans not exported yet.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	return t.shutdown(ctx)
+}
+
+func otlpOptionsFrom(endpoint string) ([]otlptracehttp.Option, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid OTLP endpoint `%s` - expected e.g. http://localhost:4318", endpoint)
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return options, nil
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Environment of a process started for an upgrade - the names of the listeners passed on from fd 3, the fd to report
+// ready on, and which of the listeners are from systemd.
+const (
+	UpgradeListenersEnv = "CASAOS_GATEWAY_LISTENERS"
+	UpgradeReadyFDEnv   = "CASAOS_GATEWAY_READY_FD"
+	UpgradeActivatedEnv = "CASAOS_GATEWAY_ACTIVATED"
+)
+
+// how long the new process has to start before the upgrade is given up, including checking its gateways
+const UpgradeTimeout = time.Minute
+
+var ErrUpgradeFailed = errors.New("upgrade failed")
+
+// set by systemd to the pid it watches, see sd_watchdog_enabled(3)
+const watchdogPIDEnv = "WATCHDOG_PID"
+
+// the first fd passed on to a child, after stdin, stdout and stderr
+const upgradeFDStart = 3
+
+// Upgrade is how the process was started, if for an upgrade, to take over from the previous one.
+type Upgrade struct {
+	Listeners *Listeners
+
+	// nil unless the process was started for an upgrade
+	ready *os.File
+}
+
+// Take over the listeners passed on by the previous process, if it started this one for an upgrade.
+func UpgradeFromEnv() (*Upgrade, error) {
+	names := os.Getenv(UpgradeListenersEnv)
+	readyFD := os.Getenv(UpgradeReadyFDEnv)
+	activated := os.Getenv(UpgradeActivatedEnv)
+
+	// not for the children of this process
+	os.Unsetenv(UpgradeListenersEnv)
+	os.Unsetenv(UpgradeReadyFDEnv)
+	os.Unsetenv(UpgradeActivatedEnv)
+
+	if readyFD == "" {
+		return &Upgrade{Listeners: NewListeners()}, nil
+	}
+
+	fd, err := strconv.Atoi(readyFD)
+	if err != nil || fd < upgradeFDStart {
+		return nil, fmt.Errorf("%w: invalid %s %s", ErrUpgradeFailed, UpgradeReadyFDEnv, readyFD)
+	}
+
+	var listenerNames []string
+	if names != "" {
+		listenerNames = strings.Split(names, ",")
+	}
+
+	files := make([]*os.File, 0, len(listenerNames))
+	for i, name := range listenerNames {
+		files = append(files, os.NewFile(uintptr(upgradeFDStart+i), name))
+	}
+
+	listeners, err := InheritListeners(listenerNames, files)
+	if err != nil {
+		return nil, err
+	}
+
+	if activated != "" {
+		listeners.setActivated(strings.Split(activated, ","))
+	}
+
+	return &Upgrade{Listeners: listeners, ready: os.NewFile(uintptr(fd), "ready")}, nil
+}
+
+// Whether the process was started for an upgrade.
+func (u *Upgrade) Upgrading() bool {
+	return u.ready != nil
+}
+
+// Tell the previous process that this one is ready to take over, if it was started for an upgrade.
+func (u *Upgrade) NotifyReady() error {
+	if u.ready == nil {
+		return nil
+	}
+
+	defer func() {
+		u.ready.Close()
+		u.ready = nil
+	}()
+
+	_, err := u.ready.Write([]byte{1})
+	return err
+}
+
+// Start the executable of this process again, with the same arguments and the listeners passed on, and wait for it to
+// be ready to take over. The listeners are still open in this process, which has to drain and exit after.
+func (u *Upgrade) Start(timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpgradeFailed, err.Error())
+	}
+
+	names, files, err := u.Listeners.Files()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpgradeFailed, err.Error())
+	}
+	defer closeFiles(files)
+
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUpgradeFailed, err.Error())
+	}
+	defer ready.Close()
+
+	// so that the socket files stay for the new process when this one closes its listeners
+	u.Listeners.SetUnlinkOnClose(false)
+
+	cmd := exec.Command(executable, os.Args[1:]...) // #nosec G204 - the same executable and arguments
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = upgradeEnv(os.Environ(),
+		UpgradeListenersEnv+"="+strings.Join(names, ","),
+		UpgradeReadyFDEnv+"="+strconv.Itoa(upgradeFDStart+len(files)),
+		UpgradeActivatedEnv+"="+strings.Join(u.Listeners.activatedNames(), ","),
+	)
+
+	err = cmd.Start()
+	readyWriter.Close() // only the child can write to it now, so it reads EOF if the child exits
+	if err != nil {
+		u.Listeners.SetUnlinkOnClose(true)
+		return nil, fmt.Errorf("%w: %s", ErrUpgradeFailed, err.Error())
+	}
+
+	logger.Info("New process is started for upgrade - waiting for it to be ready", zap.String("executable", executable), zap.Int("pid", cmd.Process.Pid), zap.Strings("listeners", names))
+
+	reported := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(ready, make([]byte, 1))
+		reported <- err
+	}()
+
+	// reaped whenever it exits, so that it is not left a zombie
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	select {
+	case err := <-reported:
+		if err == nil {
+			return cmd.Process, nil
+		}
+		err = fmt.Errorf("%w: new process exited before it was ready", ErrUpgradeFailed)
+		u.Listeners.SetUnlinkOnClose(true)
+		return nil, err
+
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		u.Listeners.SetUnlinkOnClose(true)
+		return nil, fmt.Errorf("%w: new process was not ready in %s", ErrUpgradeFailed, timeout)
+	}
+}
+
+// The environment of this process for the new one, with `extra`. `WATCHDOG_PID` is left out, as it names this process,
+// so that the new one keeps the systemd watchdog alive with `WATCHDOG_USEC` once it takes over.
+func upgradeEnv(environ []string, extra ...string) []string {
+	env := make([]string, 0, len(environ)+len(extra))
+	for _, variable := range environ {
+		if !strings.HasPrefix(variable, watchdogPIDEnv+"=") {
+			env = append(env, variable)
+		}
+	}
+
+	return append(env, extra...)
+}
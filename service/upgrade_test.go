@@ -0,0 +1,42 @@
+package service
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-systemd/daemon"
+	"gotest.tools/assert"
+)
+
+func TestUpgradeEnvWatchdog(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "60000000")
+	t.Setenv(watchdogPIDEnv, strconv.Itoa(os.Getpid()+1)) // the previous process
+
+	env := upgradeEnv(os.Environ(), UpgradeReadyFDEnv+"=3")
+	assert.Assert(t, hasVariable(env, UpgradeReadyFDEnv+"=3"))
+	assert.Assert(t, hasVariable(env, "WATCHDOG_USEC=60000000"))
+
+	// the new process sees the environment it is started with - restored by `t.Setenv` after the test
+	for _, variable := range os.Environ() {
+		if name, value, _ := strings.Cut(variable, "="); !hasVariable(env, variable) {
+			t.Setenv(name, value)
+			os.Unsetenv(name)
+		}
+	}
+
+	timeout, err := daemon.SdWatchdogEnabled(false)
+	assert.NilError(t, err)
+	assert.Equal(t, timeout, time.Minute)
+}
+
+func hasVariable(env []string, variable string) bool {
+	for _, v := range env {
+		if v == variable {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IceWhaleTech/CasaOS-Common/utils/logger"
+	"go.uber.org/zap"
+)
+
+// Messages to systemd, see sd_notify(3).
+const (
+	WatchdogKeepalive = "WATCHDOG=1"
+	WatchdogReloading = "RELOADING=1"
+	WatchdogReady     = "READY=1"
+	WatchdogStatus    = "STATUS="
+)
+
+// how often the status is sent - the keepalive is sent at least as often
+const WatchdogStatusInterval = 10 * time.Second
+
+// SelfCheck tells whether a part of the gateway still serves, e.g. by requesting it.
+type SelfCheck func() error
+
+// Watchdog keeps systemd informed of the gateway - a keepalive only while every self-check passes, so that systemd
+// restarts a gateway that has wedged, and a status line for `systemctl status`.
+type Watchdog struct {
+	// how long systemd waits for a keepalive, or 0 if it does not watch the gateway
+	timeout time.Duration
+
+	notify func(state string) error
+	status func() string
+
+	checks  map[string]SelfCheck
+	failing bool
+	mutex   sync.Mutex
+}
+
+// `notify` sends a message to systemd, and `status` is the current status of the gateway.
+func NewWatchdog(timeout time.Duration, notify func(state string) error, status func() string) *Watchdog {
+	return &Watchdog{
+		timeout: timeout,
+		notify:  notify,
+		status:  status,
+		checks:  make(map[string]SelfCheck),
+	}
+}
+
+// Add a self-check by `name`, replacing any by the same name.
+func (w *Watchdog) SetCheck(name string, check SelfCheck) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.checks[name] = check
+}
+
+// Run every self-check, returning what failed.
+func (w *Watchdog) Check() error {
+	w.mutex.Lock()
+	names := make([]string, 0, len(w.checks))
+	checks := make(map[string]SelfCheck, len(w.checks))
+	for name, check := range w.checks {
+		names = append(names, name)
+		checks[name] = check
+	}
+	w.mutex.Unlock()
+
+	sort.Strings(names)
+
+	errs := make([]error, 0)
+	for _, name := range names {
+		if err := checks[name](); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Send the status, and the keepalive if systemd watches the gateway, until `ctx` is done.
+func (w *Watchdog) Run(ctx context.Context) {
+	interval := WatchdogStatusInterval
+	if w.timeout > 0 && w.timeout/2 < interval {
+		// as recommended by sd_watchdog_enabled(3)
+		interval = w.timeout / 2
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		w.Tick()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Send the status, and the keepalive if systemd watches the gateway and every self-check passes.
+func (w *Watchdog) Tick() {
+	if err := w.notify(WatchdogStatus + w.status()); err != nil {
+		logger.Error("Failed to send status to systemd", zap.Any("error", err))
+	}
+
+	if w.timeout == 0 {
+		return
+	}
+
+	err := w.Check()
+
+	w.mutex.Lock()
+	wasFailing := w.failing
+	w.failing = err != nil
+	w.mutex.Unlock()
+
+	if err != nil {
+		if !wasFailing {
+			logger.Error("Self-check failed - systemd watchdog is not kept alive", zap.Any("error", err))
+		}
+		return
+	}
+
+	if wasFailing {
+		logger.Info("Self-check passes again - systemd watchdog is kept alive")
+	}
+
+	if err := w.notify(WatchdogKeepalive); err != nil {
+		logger.Error("Failed to keep systemd watchdog alive", zap.Any("error", err))
+	}
+}
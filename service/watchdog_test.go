@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestWatchdog(t *testing.T) {
+	var sent []string
+	notify := func(state string) error {
+		sent = append(sent, state)
+		return nil
+	}
+
+	watchdog := NewWatchdog(time.Minute, notify, func() string { return "Gateway on port 80" })
+
+	var gatewayErr error
+	watchdog.SetCheck(HealthServerGateway, func() error { return gatewayErr })
+	watchdog.SetCheck(HealthServerManagement, func() error { return nil })
+
+	watchdog.Tick()
+	assert.DeepEqual(t, sent, []string{"STATUS=Gateway on port 80", WatchdogKeepalive})
+
+	// no keepalive while a self-check fails, so that systemd restarts the gateway
+	sent = nil
+	gatewayErr = errors.New("connection refused")
+
+	err := watchdog.Check()
+	assert.ErrorContains(t, err, "gateway: connection refused")
+
+	watchdog.Tick()
+	assert.DeepEqual(t, sent, []string{"STATUS=Gateway on port 80"})
+
+	sent = nil
+	gatewayErr = nil
+
+	watchdog.Tick()
+	assert.DeepEqual(t, sent, []string{"STATUS=Gateway on port 80", WatchdogKeepalive})
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	var sent []string
+	notify := func(state string) error {
+		sent = append(sent, state)
+		return nil
+	}
+
+	// systemd does not watch the gateway, so only the status is sent
+	watchdog := NewWatchdog(0, notify, func() string { return "Gateway on port 80" })
+	watchdog.SetCheck(HealthServerGateway, func() error { return errors.New("not called") })
+
+	watchdog.Tick()
+	assert.DeepEqual(t, sent, []string{"STATUS=Gateway on port 80"})
+}